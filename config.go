@@ -0,0 +1,262 @@
+// Copyright 2019 Mike Gerow
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pager
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// Config describes how the pager started by Open was chosen and run, in a
+// form that can be logged or marshaled, for example to reproduce a user's
+// setup, and turned back into options with WithConfig. Options that take
+// funcs, writers, files, channels or signals are left out.
+type Config struct {
+	// Path and Args are the pager and its argv, as from SelectedPager.
+	Path string
+	Args []string
+	// Env holds the variables, as "key=value", that the pager's
+	// environment sets differently from the program's, like LESS.
+	Env []string
+	// Fallbacks are the pagers that would have been tried after PAGER.
+	Fallbacks []string
+	// Flags names the boolean options that were enabled, like
+	// "WithRestoreOnExit", in the order they're documented.
+	Flags       []string
+	Prompt      string
+	MaxDuration time.Duration
+	PreFilter   []string
+	PostProcess []string
+	ContentType string
+	Streams     Streams
+	Charset     string
+	Argv0       string
+	// Allowlist holds the pagers given by WithPagerAllowlist, if any.
+	Allowlist []string
+	// ShortPrompt is set by WithLongPrompt(false).
+	ShortPrompt       bool
+	AutoPageThreshold int
+	PipeBufferSize    int
+	DisableEnvVar     string
+	// EnvPrecedence and NoPagerValues are nil unless set by
+	// WithEnvPrecedence and WithNoPagerValues.
+	EnvPrecedence []string
+	NoPagerValues []string
+	Footer        string
+	// Pager, StdoutPager and StderrPager are the names and arguments given
+	// by WithPager, WithStdoutPager and WithStderrPager.
+	Pager             []string
+	StdoutPager       []string
+	StderrPager       []string
+	ContentTypePagers map[string][]string
+	// LessFlags are the flags given by WithLessFlag, in order.
+	LessFlags []LessFlag
+	// RawLessEnv is the value given by WithRawLessEnv, or nil.
+	RawLessEnv *string
+	Credential *syscall.Credential
+}
+
+// LessFlag is a flag given by WithLessFlag.
+type LessFlag struct {
+	Flag       string
+	MinVersion int
+}
+
+// EffectiveConfig returns the configuration of the pager started by the last
+// successful call to Open. It returns the zero Config if no pager is running.
+func EffectiveConfig() Config {
+	s := current()
+	if s == nil {
+		return Config{}
+	}
+	c := s.opts.config()
+	c.Path = s.path
+	c.Args = append([]string(nil), s.argv...)
+	c.Env = envChanges(s.env, os.Environ())
+	return c
+}
+
+// config returns the Config describing o, leaving out the chosen pager.
+func (o *options) config() Config {
+	c := Config{
+		Fallbacks:         copyStrings(o.fallbacks),
+		Prompt:            o.prompt,
+		MaxDuration:       o.maxDuration,
+		PreFilter:         copyStrings(o.preFilter),
+		PostProcess:       copyStrings(o.postProcess),
+		ContentType:       o.contentType,
+		Streams:           o.streams,
+		Charset:           o.charset,
+		Argv0:             o.argv0,
+		Allowlist:         copyStrings(o.allowlist),
+		ShortPrompt:       !o.longPrompt,
+		AutoPageThreshold: o.pageThreshold,
+		PipeBufferSize:    o.pipeSize,
+		DisableEnvVar:     o.disableEnv,
+		EnvPrecedence:     copyStrings(o.envPrecedence),
+		NoPagerValues:     copyStrings(o.noPagerValues),
+		Footer:            o.footer,
+		Pager:             copyStrings(o.pager),
+		StdoutPager:       copyStrings(o.stdoutPager),
+		StderrPager:       copyStrings(o.stderrPager),
+	}
+	if c.Fallbacks == nil {
+		c.Fallbacks = copyStrings(DefaultFallbacks)
+	}
+	if o.typePagers != nil {
+		c.ContentTypePagers = make(map[string][]string, len(o.typePagers))
+		for t, pager := range o.typePagers {
+			c.ContentTypePagers[t] = copyStrings(pager)
+		}
+	}
+	for _, f := range o.versionedFlags {
+		c.LessFlags = append(c.LessFlags, LessFlag{f.flag, f.minVersion})
+	}
+	if o.rawLess != nil {
+		less := *o.rawLess
+		c.RawLessEnv = &less
+	}
+	if o.credential != nil {
+		cred := *o.credential
+		c.Credential = &cred
+	}
+	for _, f := range flags {
+		if f.set(o) {
+			c.Flags = append(c.Flags, f.name)
+		}
+	}
+	return c
+}
+
+// WithConfig sets the options c describes, as EffectiveConfig returned it or
+// as it was unmarshaled, so that a logged setup can be reproduced. Options
+// Config leaves out are left as they were. Path, Args and Env describe the
+// pager that was chosen rather than options, and are ignored, as are Flags
+// that aren't known.
+func WithConfig(c Config) Option {
+	return func(o *options) {
+		if c.Fallbacks != nil {
+			o.fallbacks = copyStrings(c.Fallbacks)
+		}
+		o.prompt = c.Prompt
+		o.maxDuration = c.MaxDuration
+		o.preFilter = copyStrings(c.PreFilter)
+		o.postProcess = copyStrings(c.PostProcess)
+		o.contentType = c.ContentType
+		o.charset = c.Charset
+		o.argv0 = c.Argv0
+		o.allowlist = copyStrings(c.Allowlist)
+		o.longPrompt = !c.ShortPrompt
+		o.pageThreshold = c.AutoPageThreshold
+		o.pipeSize = c.PipeBufferSize
+		o.disableEnv = c.DisableEnvVar
+		o.envPrecedence = copyStrings(c.EnvPrecedence)
+		o.noPagerValues = copyStrings(c.NoPagerValues)
+		o.footer = c.Footer
+		o.pager = copyStrings(c.Pager)
+		o.stdoutPager = copyStrings(c.StdoutPager)
+		o.stderrPager = copyStrings(c.StderrPager)
+		o.typePagers = nil
+		if c.ContentTypePagers != nil {
+			o.typePagers = make(map[string][]string, len(c.ContentTypePagers))
+			for t, pager := range c.ContentTypePagers {
+				o.typePagers[t] = copyStrings(pager)
+			}
+		}
+		o.versionedFlags = nil
+		for _, f := range c.LessFlags {
+			o.versionedFlags = append(o.versionedFlags, versionedFlag{f.Flag, f.MinVersion})
+		}
+		o.rawLess = nil
+		if c.RawLessEnv != nil {
+			less := *c.RawLessEnv
+			o.rawLess = &less
+		}
+		o.credential = nil
+		if c.Credential != nil {
+			cred := *c.Credential
+			o.credential = &cred
+		}
+		// Streams is set after clearing the flags, of which
+		// WithPageStderrOnly changes it too.
+		for _, f := range flags {
+			f.with(false)(o)
+		}
+		o.streams = c.Streams
+		for _, name := range c.Flags {
+			for _, f := range flags {
+				if f.name == name {
+					f.with(true)(o)
+				}
+			}
+		}
+	}
+}
+
+// copyStrings returns a copy of s, which is nil only if s is.
+func copyStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append([]string{}, s...)
+}
+
+// flags lists the boolean options for Config.Flags.
+var flags = []struct {
+	name string
+	set  func(o *options) bool
+	with func(bool) Option
+}{
+	{"WithForwardInterrupt", func(o *options) bool { return o.forwardInterrupt }, WithForwardInterrupt},
+	{"WithPageDumbTerminals", func(o *options) bool { return o.pageDumbTerminals }, WithPageDumbTerminals},
+	{"WithRestoreOnExit", func(o *options) bool { return o.restoreOnExit }, WithRestoreOnExit},
+	{"WithNoSignalHandling", func(o *options) bool { return o.noSignalHandling }, WithNoSignalHandling},
+	{"WithMultiplexerAware", func(o *options) bool { return o.multiplexerAware }, WithMultiplexerAware},
+	{"WithSetpgid", func(o *options) bool { return o.setpgid }, WithSetpgid},
+	{"WithAutoPage", func(o *options) bool { return o.autoPage }, WithAutoPage},
+	{"WithNoColorStrip", func(o *options) bool { return o.noColorStrip }, WithNoColorStrip},
+	{"WithPTY", func(o *options) bool { return o.pty }, WithPTY},
+	{"WithNoInitialClear", func(o *options) bool { return o.noInitialClear }, WithNoInitialClear},
+	{"WithStrict", func(o *options) bool { return o.strict }, WithStrict},
+	{"WithQuiet", func(o *options) bool { return o.quiet }, WithQuiet},
+	{"WithPageStderrOnly", func(o *options) bool { return o.streams == StderrOnly }, WithPageStderrOnly},
+	{"WithSerializedWrites", func(o *options) bool { return o.serializedWrites }, WithSerializedWrites},
+	{"WithNoCharset", func(o *options) bool { return o.noCharset }, WithNoCharset},
+	{"WithLazySpawn", func(o *options) bool { return o.lazySpawn }, WithLazySpawn},
+	{"WithSizeEnv", func(o *options) bool { return o.sizeEnv }, WithSizeEnv},
+	{"WithLineNumbers", func(o *options) bool { return o.lineNumbers }, WithLineNumbers},
+	{"WithIgnoreEnv", func(o *options) bool { return o.ignoreEnv }, WithIgnoreEnv},
+	{"WithHangupHandling", func(o *options) bool { return o.hangupHandling }, WithHangupHandling},
+	{"WithReplayOnExit", func(o *options) bool { return o.replayOnExit }, WithReplayOnExit},
+	{"WithForce", func(o *options) bool { return o.force }, WithForce},
+	{"WithAlwaysStayOpen", func(o *options) bool { return o.alwaysStayOpen }, WithAlwaysStayOpen},
+	{"WithLineFlush", func(o *options) bool { return o.lineFlush }, WithLineFlush},
+}
+
+// envChanges returns the entries of env that aren't in base.
+func envChanges(env, base []string) []string {
+	inBase := make(map[string]bool, len(base))
+	for _, kv := range base {
+		inBase[kv] = true
+	}
+	var changes []string
+	for _, kv := range env {
+		if !inBase[kv] {
+			changes = append(changes, kv)
+		}
+	}
+	return changes
+}
@@ -0,0 +1,141 @@
+// Copyright 2019 Mike Gerow
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pager
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// env returns the environment to start the pager with.
+func (o *options) env() []string {
+	env := os.Environ()
+	if o.rawLess != nil {
+		env = replaceEnv(env, "LESS", *o.rawLess)
+	} else {
+		// add reasonable defaults for less.
+		env = defaultEnv(env, "LESS", o.lessFlags())
+		if o.multiplexerAware && inMultiplexer() && !noColor() {
+			// Colors don't make it through tmux and screen without -R.
+			// Putting it first leaves any flags the user set in control.
+			less, _ := lookupEnv(env, "LESS")
+			env = replaceEnv(env, "LESS", "-R "+less)
+		}
+	}
+	if o.sizeEnv {
+		if rows, cols := screenSize(o.ttyFD()); rows > 0 && cols > 0 {
+			env = replaceEnv(env, "LINES", strconv.Itoa(rows))
+			env = replaceEnv(env, "COLUMNS", strconv.Itoa(cols))
+		}
+	}
+	switch {
+	case o.noCharset:
+		// Leave LESSCHARSET as the user has it, if at all.
+	case o.charset != "":
+		env = replaceEnv(env, "LESSCHARSET", o.charset)
+	case utf8Locale():
+		env = defaultEnv(env, "LESSCHARSET", "utf-8")
+	}
+	return env
+}
+
+// utf8Locale reports whether the locale from LC_ALL, LC_CTYPE or LANG uses
+// UTF-8. Other locales are left for less to find the charset of; "C" and
+// "POSIX", which don't name one, and no locale at all count as UTF-8 since
+// that's what Go programs write.
+func utf8Locale() bool {
+	var locale string
+	for _, v := range []string{"LC_ALL", "LC_CTYPE", "LANG"} {
+		if locale = os.Getenv(v); locale != "" {
+			break
+		}
+	}
+	if locale == "" || locale == "C" || locale == "POSIX" {
+		return true
+	}
+	i := strings.IndexByte(locale, '.')
+	if i < 0 {
+		return false
+	}
+	charset := locale[i+1:]
+	if j := strings.IndexByte(charset, '@'); j >= 0 {
+		charset = charset[:j]
+	}
+	charset = strings.ToLower(strings.Replace(charset, "-", "", -1))
+	return charset == "utf8"
+}
+
+// lessFlags returns the value of LESS used when the user hasn't set one: quit
+// if the output fits on a screen (F), pass colors through (R), chop long lines
+// (S) and show the long prompt (M).
+func (o *options) lessFlags() string {
+	var flags string
+	if !o.alwaysStayOpen {
+		flags += "F"
+	}
+	// Without R less shows escape sequences rather than colors.
+	if !noColor() {
+		flags += "R"
+	}
+	flags += "S"
+	if o.longPrompt {
+		flags += "M"
+	}
+	return flags
+}
+
+// replaceEnv sets key to value in env, replacing any existing value.
+func replaceEnv(env []string, key, value string) []string {
+	prefix := key + "="
+	for i, kv := range env {
+		if strings.HasPrefix(kv, prefix) {
+			env[i] = prefix + value
+			return env
+		}
+	}
+	return append(env, prefix+value)
+}
+
+// defaultEnv sets key to value in env unless it's already set.
+func defaultEnv(env []string, key, value string) []string {
+	if _, ok := lookupEnv(env, key); ok {
+		return env
+	}
+	return append(env, key+"="+value)
+}
+
+// lookupEnv returns the value of key in env, and whether it was set.
+func lookupEnv(env []string, key string) (string, bool) {
+	prefix := key + "="
+	for _, kv := range env {
+		if strings.HasPrefix(kv, prefix) {
+			return kv[len(prefix):], true
+		}
+	}
+	return "", false
+}
+
+// inMultiplexer reports whether the program is running inside tmux or
+// screen.
+func inMultiplexer() bool {
+	return os.Getenv("TMUX") != "" || os.Getenv("STY") != ""
+}
+
+// noColor reports whether the user has asked for no colors by setting
+// NO_COLOR, following https://no-color.org.
+func noColor() bool {
+	return os.Getenv("NO_COLOR") != ""
+}
@@ -16,6 +16,7 @@ package pager_test
 
 import (
 	"fmt"
+	"io"
 
 	"github.com/gerow/pager"
 )
@@ -40,3 +41,30 @@ func ExampleOpen() {
 	// 8 hello from my pager!
 	// 9 hello from my pager!
 }
+
+func ExamplePage() {
+	pager.Page(func(w io.Writer) error {
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "%d hello from my pager!\n", i)
+		}
+		return nil
+	})
+
+	// Output:
+	// 0 hello from my pager!
+	// 1 hello from my pager!
+	// 2 hello from my pager!
+}
+
+// Tests can check what reaches the pager by giving it a program of their own,
+// here cat, which passes it on to stdout. WithForce pages even though the
+// test's stdout isn't a terminal.
+func ExampleWithPager() {
+	pager.Page(func(w io.Writer) error {
+		_, err := fmt.Fprintln(w, "hello from my pager!")
+		return err
+	}, pager.WithPager("cat"), pager.WithForce(true))
+
+	// Output:
+	// hello from my pager!
+}
@@ -0,0 +1,114 @@
+// Copyright 2019 Mike Gerow
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pager
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestMain runs the test binary as the pager when fakePager asked for it.
+func TestMain(m *testing.M) {
+	if out := os.Getenv("PAGER_FAKE_OUT"); out != "" {
+		os.Exit(runFakePager(out))
+	}
+	os.Exit(m.Run())
+}
+
+// runFakePager records what it reads on stdin to out. If PAGER_FAKE_QUIT is
+// set it quits after reading that many bytes, as if the user had quit.
+func runFakePager(out string) int {
+	f, err := os.Create(out)
+	if err != nil {
+		return 1
+	}
+	defer f.Close()
+	var r io.Reader = os.Stdin
+	if n, err := strconv.Atoi(os.Getenv("PAGER_FAKE_QUIT")); err == nil {
+		r = io.LimitReader(r, int64(n))
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		return 1
+	}
+	return 0
+}
+
+// fakePager makes Open act as if it were running on a terminal and use the
+// test binary as the pager, returning the file the pager records what it
+// reads to. If quitAfter isn't negative the pager quits after reading that
+// many bytes.
+func fakePager(t *testing.T, quitAfter int) string {
+	t.Helper()
+	exe, err := os.Executable()
+	if err != nil {
+		t.Skip(err)
+	}
+	testPager(t, "")
+	out := filepath.Join(t.TempDir(), "out")
+	setenv(t, "PAGER", exe)
+	setenv(t, "PAGER_FAKE_OUT", out)
+	if quitAfter >= 0 {
+		setenv(t, "PAGER_FAKE_QUIT", strconv.Itoa(quitAfter))
+	}
+	old := isSelf
+	isSelf = func(string) bool { return false }
+	t.Cleanup(func() { isSelf = old })
+	return out
+}
+
+func TestFakePager(t *testing.T) {
+	out := fakePager(t, -1)
+	if err := Open(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		fmt.Printf("%d hello from my pager!\n", i)
+	}
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	const want = "0 hello from my pager!\n1 hello from my pager!\n2 hello from my pager!\n"
+	if got, err := os.ReadFile(out); err != nil || string(got) != want {
+		t.Errorf("pager read %q, %v, want %q", got, err, want)
+	}
+}
+
+func TestFakePagerQuit(t *testing.T) {
+	out := fakePager(t, 5)
+	line := []byte(strings.Repeat("x", 1023) + "\n")
+	var werr error
+	err := Page(func(w io.Writer) error {
+		// Far more than fits in the pipe, so writes fail once the pager
+		// has quit.
+		for i := 0; i < 1024 && werr == nil; i++ {
+			_, werr = w.Write(line)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if werr != ErrPagerClosed {
+		t.Errorf("write after the pager quit = %v, want %v", werr, ErrPagerClosed)
+	}
+	if got, err := os.ReadFile(out); err != nil || string(got) != "xxxxx" {
+		t.Errorf("pager read %q, %v, want the first 5 bytes", got, err)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2019 Mike Gerow
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pager
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// startFilter starts argv[0] with argv between the program and the pager, so
+// that everything written to p.pw passes through it first.
+func (p *pgr) startFilter(argv []string) error {
+	path, err := exec.LookPath(argv[0])
+	if err != nil {
+		return err
+	}
+	fr, fw, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	p.opts.resizePipe(fw)
+	filter, err := os.StartProcess(path, argv, &os.ProcAttr{
+		Files: []*os.File{fr, p.pw, os.Stderr},
+	})
+	fr.Close()
+	if err != nil {
+		fw.Close()
+		return err
+	}
+	// The filter now holds the pager's end of the pipe; once it exits the
+	// pager sees EOF.
+	p.pw.Close()
+	p.pw = fw
+	p.filter = filter
+	return nil
+}
+
+// waitFilter waits for the filter, if any, to exit. A filter killed by
+// SIGPIPE because the user quit the pager before it finished isn't an error.
+func (p *pgr) waitFilter() error {
+	if p.filter == nil {
+		return nil
+	}
+	state, err := p.filter.Wait()
+	if err != nil {
+		return err
+	}
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() && ws.Signal() == syscall.SIGPIPE {
+		return nil
+	}
+	if !state.Success() {
+		return &exec.ExitError{ProcessState: state}
+	}
+	return nil
+}
+
+// startPostProcess runs argv[0] with argv on the program's output on its way
+// to the pager, from a goroutine that closes p.postProcessed once done. The
+// output is also held in memory, and if the command fails before writing
+// anything, what it was given goes to the pager instead. If it can't be
+// found, output goes to the pager unprocessed.
+func (p *pgr) startPostProcess(argv []string) error {
+	path, err := exec.LookPath(argv[0])
+	if err != nil {
+		if !p.opts.quiet {
+			log.Printf("Not post-processing output since %v", err)
+		}
+		return nil
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	p.opts.resizePipe(pw)
+	var raw bytes.Buffer
+	out := &countingWriter{w: p.pw}
+	cmd := &exec.Cmd{
+		Path:   path,
+		Args:   argv,
+		Stdin:  io.TeeReader(pr, &raw),
+		Stdout: out,
+		Stderr: os.Stderr,
+	}
+	if err := cmd.Start(); err != nil {
+		pr.Close()
+		pw.Close()
+		if !p.opts.quiet {
+			log.Printf("Not post-processing output since %v", err)
+		}
+		return nil
+	}
+	dst := p.pw
+	p.pw, p.postProcess = pw, cmd.Process
+	p.postProcessed = make(chan struct{})
+	go func() {
+		defer close(p.postProcessed)
+		defer dst.Close()
+		defer pr.Close()
+		err := cmd.Wait()
+		// Take in the rest of the output, which the command may not
+		// have read, so the program isn't left blocked writing it.
+		io.Copy(&raw, pr)
+		if err != nil && out.n == 0 {
+			dst.Write(raw.Bytes())
+		}
+	}()
+	return nil
+}
+
+// countingWriter counts the bytes written through it to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,1029 @@
+// Copyright 2019 Mike Gerow
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pager
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// An Option configures how Open selects and runs a pager.
+type Option func(*options)
+
+type options struct {
+	// fallbacks is nil unless set by WithFallbacks, in which case it
+	// replaces DefaultFallbacks.
+	fallbacks []string
+	timings   func(phase string, d time.Duration)
+	prompt    string
+
+	forwardInterrupt  bool
+	onInterrupt       func()
+	pageDumbTerminals bool
+	maxDuration       time.Duration
+	restoreOnExit     bool
+	closeSignal       os.Signal
+	rawLess           *string
+	capture           io.Writer
+	quitSignal        os.Signal
+	noSignalHandling  bool
+	multiplexerAware  bool
+	abortOnWriteError func(error)
+	preFilter         []string
+	setpgid           bool
+	autoPage          bool
+	fitCalculator     func(buf []byte, rows, cols int) bool
+	noColorStrip      bool
+	pty               bool
+	provider          func() (name string, args []string, ok bool)
+	noInitialClear    bool
+	// envPrecedence is nil unless set by WithEnvPrecedence, in which case
+	// it replaces PAGER.
+	envPrecedence []string
+	strict        bool
+	quiet         bool
+	streams       Streams
+	contentType   string
+	typePagers    map[string][]string
+	longPrompt    bool
+	// serializedWrites is set by WithSerializedWrites.
+	serializedWrites bool
+	charset          string
+	preSpawn         func(path string, argv, env []string) (string, []string, []string, error)
+	lazySpawn        bool
+	sizeEnv          bool
+	// logger is set by OpenVerbose.
+	logger      *log.Logger
+	lineNumbers bool
+	disableEnv  string
+	ignoreEnv   bool
+	// hangupHandling is set by WithHangupHandling.
+	hangupHandling bool
+	pagerStderr    io.Writer
+	footer         string
+	versionedFlags []versionedFlag
+	pageThreshold  int
+	allowlist      []string
+	credential     *syscall.Credential
+	replayOnExit   bool
+	flush          func() error
+	pager          []string
+	force          bool
+	noCharset      bool
+	postProcess    []string
+	// exitCodeHandler is set by WithExitCodeHandler.
+	exitCodeHandler func(code int) error
+	pipeSize        int
+	signalChan      chan<- os.Signal
+	argv0           string
+	// noPagerValues is nil unless set by WithNoPagerValues.
+	noPagerValues  []string
+	alwaysStayOpen bool
+	lineFlush      bool
+	// stdoutPager and stderrPager are set by WithStdoutPager and
+	// WithStderrPager.
+	stdoutPager, stderrPager []string
+	// noVersionProbe is set by Plan, which mustn't run less --version.
+	noVersionProbe bool
+}
+
+// versionedFlag is a less flag given by WithLessFlag.
+type versionedFlag struct {
+	flag       string
+	minVersion int
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		closeSignal: unix.SIGCONT,
+		quitSignal:  unix.SIGTERM,
+		longPrompt:  true,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithFallbacks replaces DefaultFallbacks, the list of pagers tried in order
+// when PAGER isn't set or can't be started. Duplicate names, and names
+// matching the pager from PAGER, are only tried once. Every name must be
+// non-empty; Open returns an error otherwise.
+func WithFallbacks(names ...string) Option {
+	return func(o *options) {
+		o.fallbacks = append([]string{}, names...)
+	}
+}
+
+// WithTimings registers a hook that is called with the duration of each phase
+// of a paging session. The phases are "select", finding and starting a pager,
+// "spawn", the os.StartProcess call that started it, and "wait", the time
+// Close spends waiting for the pager to exit.
+func WithTimings(f func(phase string, d time.Duration)) Option {
+	return func(o *options) {
+		o.timings = f
+	}
+}
+
+func nop() {}
+
+// phase starts timing the named phase and returns a func that reports it to
+// the WithTimings hook. Without a hook it returns a no-op.
+func (o *options) phase(name string) func() {
+	if o.timings == nil {
+		return nop
+	}
+	start := time.Now()
+	return func() {
+		o.timings(name, time.Since(start))
+	}
+}
+
+// WithPrompt sets the prompt shown by the pager, for example to the command
+// line that produced the output. It is only supported for less, where it is
+// passed with -P; other pagers ignore it.
+func WithPrompt(prompt string) Option {
+	return func(o *options) {
+		o.prompt = prompt
+	}
+}
+
+// WithForwardInterrupt makes the program relay SIGINT to the pager while it
+// runs instead of ignoring it, so the program can react to interrupts too.
+// The prior handling of SIGINT is restored by Close.
+//
+// Interrupts typed at the terminal already reach the pager since it runs in
+// the program's process group, so with this option it sees those twice;
+// pagers like less treat repeated interrupts the same as one.
+func WithForwardInterrupt(forward bool) Option {
+	return func(o *options) {
+		o.forwardInterrupt = forward
+	}
+}
+
+// WithOnInterrupt registers f to be called after each SIGINT forwarded to the
+// pager. It has no effect unless WithForwardInterrupt is also given.
+func WithOnInterrupt(f func()) Option {
+	return func(o *options) {
+		o.onInterrupt = f
+	}
+}
+
+// WithPageDumbTerminals makes Open start a pager even if TERM is unset or
+// "dumb". Stdout and stderr must still be terminals.
+func WithPageDumbTerminals(page bool) Option {
+	return func(o *options) {
+		o.pageDumbTerminals = page
+	}
+}
+
+// WithMaxDuration limits how long the pager may stay open. Once d has passed
+// since Open, output is restored to where it was before Open and the pager is
+// ended as if by Quit; Close then returns without error. A pager the user
+// quits sooner is unaffected.
+func WithMaxDuration(d time.Duration) Option {
+	return func(o *options) {
+		o.maxDuration = d
+	}
+}
+
+// WithRestoreOnExit makes output go back to where it was before Open as soon
+// as the pager exits, rather than at Close. Without it, writes made after the
+// user quits the pager fail, which by default kills the program with SIGPIPE;
+// with it they carry on to the terminal. Writes in flight as the pager exits
+// fail with EPIPE rather than killing the program.
+func WithRestoreOnExit(restore bool) Option {
+	return func(o *options) {
+		o.restoreOnExit = restore
+	}
+}
+
+// WithCloseSignal sets the signal Close sends the pager once output is done,
+// in case it was stopped, before waiting for it. It defaults to SIGCONT; nil
+// sends no signal.
+func WithCloseSignal(sig os.Signal) Option {
+	return func(o *options) {
+		o.closeSignal = sig
+	}
+}
+
+// WithRawLessEnv sets LESS in the pager's environment to exactly less,
+// replacing any value the user has set as well as the package's defaults,
+// including the -R of WithMultiplexerAware. Options that pass less flags on
+// its command line, WithPrompt, WithNoInitialClear, WithLineNumbers and
+// WithLessFlag, still do, and those flags override LESS.
+func WithRawLessEnv(less string) Option {
+	return func(o *options) {
+		o.rawLess = &less
+	}
+}
+
+// WithQuitSignal sets the signal Quit sends the pager to end it. It defaults
+// to SIGTERM, which less and more both treat as a request to quit.
+func WithQuitSignal(sig os.Signal) Option {
+	return func(o *options) {
+		o.quitSignal = sig
+	}
+}
+
+// WithNoSignalHandling stops the package from changing how the program
+// handles any signal, leaving that entirely to the caller. By default SIGINT
+// is ignored while the pager runs so that interrupting the pager doesn't also
+// kill the program. This option overrides WithForwardInterrupt,
+// WithHangupHandling, WithSignalChannel and the SIGPIPE handling of
+// WithRestoreOnExit. With WithPTY the pty then keeps the size the terminal
+// had when the pager started. With WithSetpgid the program has to ignore
+// SIGTTOU itself, or it is stopped when Close gives the terminal back to it.
+func WithNoSignalHandling(none bool) Option {
+	return func(o *options) {
+		o.noSignalHandling = none
+	}
+}
+
+// WithMultiplexerAware adjusts the environment given to the pager when the
+// program runs inside tmux or screen, as detected from TMUX and STY. Currently
+// it makes sure less is passed -R so that colors render even if the user has
+// set LESS without it. It has no effect with WithRawLessEnv, or when NO_COLOR
+// is set.
+func WithMultiplexerAware(aware bool) Option {
+	return func(o *options) {
+		o.multiplexerAware = aware
+	}
+}
+
+// WithAbortOnWriteError registers f to be called with the first error writing
+// to the pager, typically because the user quit it early, so that the program
+// can stop rather than keep writing to nothing. f might, for example, call
+// os.Exit. It applies to the writer Page passes its callback; writes to stdout
+// and stderr after Open go to the pager directly and can't be intercepted.
+func WithAbortOnWriteError(f func(error)) Option {
+	return func(o *options) {
+		o.abortOnWriteError = f
+	}
+}
+
+// WithPreFilter passes everything written to the pager through the command
+// name, run with args, first. The command reads the output on its stdin and
+// must write the result to its stdout, for example to highlight syntax. Open
+// fails if the command can't be started. Close waits for the command, and
+// then the pager, to exit.
+func WithPreFilter(name string, args ...string) Option {
+	return func(o *options) {
+		o.preFilter = append([]string{name}, args...)
+	}
+}
+
+// WithPostProcess formats everything written to the pager with the command
+// name, run with args, such as column -t, before it reaches the pager and any
+// WithPreFilter. Unlike with WithPreFilter, trouble with the command doesn't
+// stop the output from being paged: if it can't be started the output is
+// paged as is, and if it fails before writing anything the output it was
+// given is paged instead. For that the output is held in memory until Close.
+func WithPostProcess(name string, args ...string) Option {
+	return func(o *options) {
+		o.postProcess = append([]string{name}, args...)
+	}
+}
+
+// WithSetpgid runs the pager in its own process group and makes that the
+// terminal's foreground group until the pager exits, when Close gives the
+// terminal back. The terminal then delivers Ctrl-C and Ctrl-Z to the pager
+// alone, as the shell would for a pager at the end of a pipeline.
+//
+// Since interrupts typed at the terminal no longer reach the program, SIGINT
+// isn't ignored while the pager runs as it otherwise is; an interrupt sent to
+// the program directly still stops it.
+//
+// The tradeoff is job control: Ctrl-Z stops only the pager, so the shell
+// doesn't get its prompt back. Open fails to start a pager if the terminal
+// it pages to, stdout or with StderrOnly stderr, isn't the program's
+// controlling terminal.
+func WithSetpgid(setpgid bool) Option {
+	return func(o *options) {
+		o.setpgid = setpgid
+	}
+}
+
+// WithAutoPage makes Page hold output back while it fits on the screen,
+// writing it straight to stdout if it still fits once the callback returns,
+// and only start a pager once it doesn't. Less does the same for the default
+// pager with -F, but this works for any pager and avoids starting one at all.
+func WithAutoPage(auto bool) Option {
+	return func(o *options) {
+		o.autoPage = auto
+	}
+}
+
+// WithAutoPageThreshold makes Page and WrapWriter write output straight to
+// the terminal until n bytes have been written, and only then start a pager,
+// which gets the rest. Unlike WithAutoPage, which it overrides, nothing is
+// held back, so memory stays bounded however much is written. The output
+// before the pager started stays on the terminal and can't be scrolled back
+// to in the pager.
+func WithAutoPageThreshold(n int) Option {
+	return func(o *options) {
+		o.pageThreshold = n
+	}
+}
+
+// WithFitCalculator replaces how WithAutoPage decides whether output fits on
+// a screen of rows by cols. By default it counts the rows the output takes up
+// once long lines wrap, keeping one free for the shell's prompt. rows and cols
+// are zero if the size of the terminal isn't known.
+func WithFitCalculator(fits func(buf []byte, rows, cols int) bool) Option {
+	return func(o *options) {
+		o.fitCalculator = fits
+	}
+}
+
+// logf logs a step of choosing and starting a pager for OpenVerbose.
+func (o *options) logf(format string, args ...interface{}) {
+	if o.logger != nil {
+		o.logger.Printf(format, args...)
+	}
+}
+
+// fits reports whether buf fits on a screen of rows by cols.
+func (o *options) fits(buf []byte, rows, cols int) bool {
+	if o.fitCalculator != nil {
+		return o.fitCalculator(buf, rows, cols)
+	}
+	return fitsScreen(buf, rows, cols)
+}
+
+// WithNoColorStrip removes ANSI escape sequences from the output on its way
+// to the pager when NO_COLOR is set, for programs that don't check NO_COLOR
+// themselves, or when PagerSupportsColor says the pager would show them as
+// garbage. Whatever the options, the package itself honors NO_COLOR by not
+// passing less -R, unless WithRawLessEnv says otherwise.
+func WithNoColorStrip(strip bool) Option {
+	return func(o *options) {
+		o.noColorStrip = strip
+	}
+}
+
+// stripColor reports whether output to the pager at path should have ANSI
+// escapes removed.
+func (o *options) stripColor(path string) bool {
+	return o.noColorStrip && (noColor() || !PagerSupportsColor(path))
+}
+
+// WithPTY runs the pager on a pseudo-terminal of its own, which becomes its
+// stdout, stderr and controlling terminal, and copies between that and the
+// program's terminal: what the pager draws to the terminal, and keys typed at
+// the terminal to the pager. Its stdin is still the program's output. This is
+// for pagers and other programs that insist on a real terminal rather than
+// opening /dev/tty; less and more work without it.
+//
+// The terminal is in raw mode while the pager runs, so every key, Ctrl-C and
+// Ctrl-Z included, goes to the pager alone, and SIGINT isn't ignored as it
+// otherwise is. Since the pager has no shell to return to, Ctrl-Z leaves it
+// stopped. The option overrides WithSetpgid. Open fails if a pty can't be
+// allocated, which is currently the case on systems other than Linux.
+func WithPTY(pty bool) Option {
+	return func(o *options) {
+		o.pty = pty
+	}
+}
+
+// WithPagerProvider registers f to choose the pager at Open, ahead of PAGER
+// and the fallbacks, for example from a plugin that knows the kind of output.
+// If f returns ok the pager name, looked up in PATH unless it's a path, is
+// tried first with args; the name must not be empty. If it returns !ok, or
+// the pager can't be started, selection carries on as without the option.
+func WithPagerProvider(f func() (name string, args []string, ok bool)) Option {
+	return func(o *options) {
+		o.provider = f
+	}
+}
+
+// WithNoInitialClear keeps what was on the terminal before Open visible as the
+// pager starts, instead of it switching to a cleared screen. For less it
+// passes -X, which skips the alternate screen altogether, so the last page
+// shown also stays on the terminal once the user quits. more doesn't clear
+// the screen to begin with; other pagers ignore the option.
+func WithNoInitialClear(noClear bool) Option {
+	return func(o *options) {
+		o.noInitialClear = noClear
+	}
+}
+
+// WithEnvPrecedence sets the environment variables consulted, in order, for
+// the pager command, in place of just PAGER; for example "GIT_PAGER", "PAGER".
+// The first that is set to more than whitespace wins and is split with shell
+// quoting rules. With no names the environment isn't consulted at all.
+func WithEnvPrecedence(names ...string) Option {
+	return func(o *options) {
+		o.envPrecedence = append([]string{}, names...)
+	}
+}
+
+// WithStrict makes Open return an error when a pager it tries exists but can't
+// be used, for example because PAGER names a FIFO or a symlink loop, or fails
+// to start. By default Open moves on to the next pager in that case. Pagers
+// that aren't installed are skipped either way.
+func WithStrict(strict bool) Option {
+	return func(o *options) {
+		o.strict = strict
+	}
+}
+
+// WithQuiet stops Open from logging, with the standard logger, that it found
+// no pager to use, or that it skipped one because it is the program itself.
+// Output then goes to the terminal without any notice.
+func WithQuiet(quiet bool) Option {
+	return func(o *options) {
+		o.quiet = quiet
+	}
+}
+
+// WithPageStderrOnly makes Open page only stderr, leaving stdout where it
+// was, for example on a file. The pager is started if stderr is a terminal,
+// whatever stdout is, and draws to stderr. With Page and WrapWriter, which
+// leave both alone, it only changes which of them must be a terminal. It's
+// the same as WithStreams(StderrOnly).
+func WithPageStderrOnly(stderrOnly bool) Option {
+	return func(o *options) {
+		if stderrOnly {
+			o.streams = StderrOnly
+		} else if o.streams == StderrOnly {
+			o.streams = Both
+		}
+	}
+}
+
+// Streams selects which of stdout and stderr Open redirects to the pager.
+type Streams int
+
+const (
+	// Both pages stdout and stderr, and is the default.
+	Both Streams = iota
+	// StdoutOnly pages stdout, leaving stderr where it was, so that errors
+	// show up on the terminal as they happen. The pager is started if
+	// stdout is a terminal, whatever stderr is.
+	StdoutOnly
+	// StderrOnly pages stderr, as WithPageStderrOnly describes.
+	StderrOnly
+)
+
+// streamNames are the names Streams marshals to, as text.
+var streamNames = []string{"both", "stdout", "stderr"}
+
+func (s Streams) String() string {
+	if s < 0 || int(s) >= len(streamNames) {
+		return fmt.Sprintf("Streams(%d)", int(s))
+	}
+	return streamNames[s]
+}
+
+// MarshalText returns the name of s, such as "stdout" for StdoutOnly, so
+// that a Config marshals it readably.
+func (s Streams) MarshalText() ([]byte, error) {
+	if s < 0 || int(s) >= len(streamNames) {
+		return nil, fmt.Errorf("pager: unknown %v", s)
+	}
+	return []byte(streamNames[s]), nil
+}
+
+// UnmarshalText sets s from a name returned by MarshalText.
+func (s *Streams) UnmarshalText(text []byte) error {
+	for i, name := range streamNames {
+		if string(text) == name {
+			*s = Streams(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("pager: unknown streams %q", text)
+}
+
+// WithStreams sets which of stdout and stderr Open redirects to the pager.
+// Close restores just those.
+func WithStreams(s Streams) Option {
+	return func(o *options) {
+		o.streams = s
+	}
+}
+
+// ttyFD returns the descriptor of the terminal the pager draws to.
+func (o *options) ttyFD() int {
+	if o.streams == StderrOnly {
+		return unix.Stderr
+	}
+	return unix.Stdout
+}
+
+// WithContentType tells Open what kind of output is about to be paged, as a
+// MIME type such as "text/x-go", so that a pager suited to it can be tried
+// first. The pagers for each type are given by WithContentTypePagers.
+func WithContentType(contentType string) Option {
+	return func(o *options) {
+		o.contentType = contentType
+	}
+}
+
+// WithContentTypePagers maps content types to the pager commands to try, in
+// order, for output of that type, after PAGER but before the fallbacks. The
+// commands are split with shell quoting rules, and aren't given
+// PAGER_DEFAULT_ARGS. A key of the form "text/*" matches every type that
+// has no entry of its own with that major type. For example:
+//
+//	pager.WithContentTypePagers(map[string][]string{
+//		"text/x-go": {"bat --paging=always --language=go"},
+//		"text/*":    {"less"},
+//	})
+func WithContentTypePagers(pagers map[string][]string) Option {
+	return func(o *options) {
+		o.typePagers = pagers
+	}
+}
+
+// contentPagers returns the commands WithContentTypePagers gives for the
+// WithContentType type, ignoring any parameters like charset.
+func (o *options) contentPagers() []string {
+	if o.contentType == "" || o.typePagers == nil {
+		return nil
+	}
+	t := o.contentType
+	if i := strings.IndexByte(t, ';'); i >= 0 {
+		t = t[:i]
+	}
+	t = strings.ToLower(strings.TrimSpace(t))
+	if commands, ok := o.typePagers[t]; ok {
+		return commands
+	}
+	if i := strings.IndexByte(t, '/'); i >= 0 {
+		return o.typePagers[t[:i]+"/*"]
+	}
+	return nil
+}
+
+// WithLongPrompt sets whether less shows its long prompt, with the position
+// in the output as lines and a percentage, or its short one. It defaults to
+// true. Like the rest of the package's defaults for less, it has no effect if
+// the user has set LESS, or with WithRawLessEnv.
+func WithLongPrompt(long bool) Option {
+	return func(o *options) {
+		o.longPrompt = long
+	}
+}
+
+// WithSerializedWrites keeps large writes to os.Stdout and os.Stderr from
+// different goroutines from interleaving in the pager, by setting os.Stderr
+// to os.Stdout until the output is restored. The runtime already serializes
+// writes through a single *os.File. Code that saved os.Stderr before Open,
+// like the standard logger, keeps writing through its own *os.File, and the
+// program must not read os.Stderr concurrently with Open, Close and Quit.
+// WithRestoreOnExit, WithMaxDuration and WithHangupHandling restore output
+// from a goroutine of their own, where setting os.Stderr back would race with
+// the program, so Open returns ErrSerializedAsync if one of them is given too.
+// It has no effect with WithPageStderrOnly.
+func WithSerializedWrites(serialized bool) Option {
+	return func(o *options) {
+		o.serializedWrites = serialized
+	}
+}
+
+// WithCharset sets LESSCHARSET in the pager's environment to charset,
+// replacing any value the user has set. Without it LESSCHARSET defaults to
+// utf-8 when the locale, from LC_ALL, LC_CTYPE or LANG, is a UTF-8 one or
+// isn't set, and is otherwise left for less to derive from the locale.
+func WithCharset(charset string) Option {
+	return func(o *options) {
+		o.charset = charset
+	}
+}
+
+// WithNoCharset leaves LESSCHARSET alone, so that the pager gets whatever
+// value the user has set, or none, rather than utf-8 by default. It overrides
+// WithCharset.
+func WithNoCharset(noCharset bool) Option {
+	return func(o *options) {
+		o.noCharset = noCharset
+	}
+}
+
+// WithPreSpawn registers f to be called right before each pager Open tries is
+// started, with the path, argv and environment it's about to be started with.
+// The pager is started with the path, argv and environment f returns instead,
+// which may be the ones it was given, changed copies, or another command
+// altogether, for example one running the pager under env. If f returns an
+// error, Open starts no pager and returns it.
+func WithPreSpawn(f func(path string, argv, env []string) (string, []string, []string, error)) Option {
+	return func(o *options) {
+		o.preSpawn = f
+	}
+}
+
+// WithLazySpawn makes Page start the pager only once its callback first
+// writes, so that a callback that ends up writing nothing doesn't flash the
+// pager's screen. WrapWriter always works this way; Open, which redirects
+// stdout and stderr before anything is written, ignores the option. Combine
+// it with WithAutoPage to also skip the pager for output that fits.
+func WithLazySpawn(lazy bool) Option {
+	return func(o *options) {
+		o.lazySpawn = lazy
+	}
+}
+
+// WithSizeEnv sets LINES and COLUMNS in the pager's environment to the size
+// of the terminal, for pagers that read them rather than ask the terminal,
+// which they can't when the terminal isn't their stdout. Values the user has
+// set are replaced. Nothing is set if the size can't be found.
+func WithSizeEnv(size bool) Option {
+	return func(o *options) {
+		o.sizeEnv = size
+	}
+}
+
+// WithLineNumbers makes the pager number lines. For less it passes -N, unless
+// PAGER already does; other pagers ignore it.
+func WithLineNumbers(numbers bool) Option {
+	return func(o *options) {
+		o.lineNumbers = numbers
+	}
+}
+
+// WithDisableEnvVar makes Open, Page and WrapWriter skip paging whenever the
+// environment variable name, like MYAPP_NO_PAGER, is set to 1, true or yes,
+// in any case and ignoring surrounding space, taking precedence over every
+// other option. Other values, including an empty one, leave paging on.
+func WithDisableEnvVar(name string) Option {
+	return func(o *options) {
+		o.disableEnv = name
+	}
+}
+
+// WithIgnoreEnv makes the choice of pager independent of the environment, for
+// scripts that must behave the same for every user: PAGER, or the variables
+// given by WithEnvPrecedence, and PAGER_DEFAULT_ARGS are ignored, leaving the
+// pagers the program configures and the fallbacks. The pager itself still
+// inherits the environment, including LESS.
+func WithIgnoreEnv(ignore bool) Option {
+	return func(o *options) {
+		o.ignoreEnv = ignore
+	}
+}
+
+// WithHangupHandling makes the program outlive its terminal hanging up while
+// the pager runs, as when an ssh connection drops. On SIGHUP, output is
+// restored to where it was before Open and the pager is sent SIGHUP, and
+// Close, or Quit, returns ErrHangup once it has exited. The program can then
+// exit cleanly; writes to the terminal fail from then on. Without the option
+// SIGHUP kills the program as usual. WithNoSignalHandling overrides it.
+func WithHangupHandling(handle bool) Option {
+	return func(o *options) {
+		o.hangupHandling = handle
+	}
+}
+
+// WithPagerStderr sets the pager's own stderr, where it reports errors like
+// files it can't read, to f instead of the program's stderr as it was before
+// Open. It applies to Open, Page and WrapWriter, but not with WithPTY, which
+// gives the pager the pty for stderr. more reads keystrokes from its stderr,
+// so f should be the terminal if more may be used.
+func WithPagerStderr(f *os.File) Option {
+	return func(o *options) {
+		o.pagerStderr = f
+	}
+}
+
+// WithPagerDiagnostics is like WithPagerStderr, but for any writer, so that a
+// program can capture and reformat what the pager reports. Unless w is an
+// *os.File, the pager writes to a pipe that's copied to w, and Close returns
+// once all of it has been. more can't read keystrokes from such a pipe.
+func WithPagerDiagnostics(w io.Writer) Option {
+	return func(o *options) {
+		o.pagerStderr = w
+	}
+}
+
+// WithFooter prints footer to the terminal once the user has quit the pager,
+// when Close or Page's pager has returned output to the terminal, for example
+// to mention how to turn paging off. It isn't printed if no pager was started,
+// if the pager is cat, or if Close fails first. footer is printed as is, so
+// it should usually end with a newline.
+func WithFooter(footer string) Option {
+	return func(o *options) {
+		o.footer = footer
+	}
+}
+
+// WithLessFlag passes flag to less if it's at least version minVersion, such
+// as 551 for --mouse, so that older versions, which would refuse to start
+// with a flag they don't know, still work. The version is found by running
+// less --version the first time a given less is used; a less whose version
+// can't be told gets none of these flags.
+func WithLessFlag(flag string, minVersion int) Option {
+	return func(o *options) {
+		o.versionedFlags = append(o.versionedFlags, versionedFlag{flag, minVersion})
+	}
+}
+
+// WithPagerAllowlist restricts the pagers Open may start to those in pagers,
+// each either an absolute path or a base name, which allows a pager of that
+// name anywhere. Others, as a PAGER set by someone else may name, are skipped
+// for the next candidate, or with WithStrict make Open return an error. An
+// empty list, the default, allows any pager. WithPreSpawn may still change
+// the pager that's started.
+func WithPagerAllowlist(pagers []string) Option {
+	return func(o *options) {
+		o.allowlist = append([]string(nil), pagers...)
+	}
+}
+
+// allowed reports whether path may be started under WithPagerAllowlist.
+func (o *options) allowed(path string) bool {
+	if len(o.allowlist) == 0 {
+		return true
+	}
+	for _, a := range o.allowlist {
+		if a == path || !strings.Contains(a, "/") && a == filepath.Base(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// WithCredential runs the pager, and so any LESSOPEN filter it runs, as the
+// user and groups in cred, so that a program running as root can page
+// without the pager running as root too. Changing user needs privilege, as
+// on any Unix; the pager also has to be able to open the terminal as that
+// user, which less does through /dev/tty.
+func WithCredential(cred *syscall.Credential) Option {
+	return func(o *options) {
+		o.credential = cred
+	}
+}
+
+// WithReplayOnExit writes everything that was paged to the terminal once the
+// user has quit the pager, before any WithFooter, so that it stays in the
+// terminal's scrollback to be searched later. All of the output is held in
+// memory until then, so it's unsuited to very large outputs. Output is
+// replayed as the pager got it, without colors if WithNoColorStrip stripped
+// them. Nothing is replayed if the pager is cat, which already wrote it to
+// the terminal.
+func WithReplayOnExit(replay bool) Option {
+	return func(o *options) {
+		o.replayOnExit = replay
+	}
+}
+
+// WithFlush has Close, Quit and RunPaged call flush before they restore
+// stdout and stderr, so that a program writing to stdout through a buffer,
+// such as a bufio.Writer, can flush it while it still leads to the pager.
+// flush is called first thing, before os.Stdout and os.Stderr are synced,
+// and an error from it is returned once the pager has been closed, unless
+// closing it failed too. It isn't called when the pager ends any other way,
+// as with WithMaxDuration, since that happens on another goroutine.
+func WithFlush(flush func() error) Option {
+	return func(o *options) {
+		o.flush = flush
+	}
+}
+
+// WithPager makes name, run with args, the only pager Open tries, ignoring
+// the environment and the fallbacks. With WithForce it lets a test exercise
+// the real path of starting and closing a pager against a known program, such
+// as a script recording what it reads, without depending on less being
+// installed or on running in a terminal.
+func WithPager(name string, args ...string) Option {
+	return func(o *options) {
+		o.pager = append([]string{name}, args...)
+	}
+}
+
+// WithForce makes Open page even if stdout and stderr aren't terminals, or
+// TERM names a dumb one. It's meant for tests, together with WithPager; a
+// pager like less is of little use without a terminal. WithDisableEnvVar
+// still turns paging off.
+func WithForce(force bool) Option {
+	return func(o *options) {
+		o.force = force
+	}
+}
+
+// WithExitCodeHandler decides what Close returns, as do Page and the Close of
+// WrapWriter's writer, when the pager exits unsuccessfully: h is called with
+// its exit code, or -1 if a signal killed it, and the error h returns is
+// returned instead of an *exec.ExitError, so that a pager's benign exit codes
+// can be treated as success. h isn't called when
+// the pager exits with 0, or was ended by Quit or WithMaxDuration.
+func WithExitCodeHandler(h func(code int) error) Option {
+	return func(o *options) {
+		o.exitCodeHandler = h
+	}
+}
+
+// WithPipeBufferSize enlarges the pipe to the pager to hold n bytes, on Linux,
+// so that a program writing a lot of output to a pager that's slow to read it
+// blocks less often. The kernel rounds n up to a power of two number of pages,
+// and without privilege limits it to /proc/sys/fs/pipe-max-size; if it can't
+// be set, the pipe keeps its default size of 64KiB. Elsewhere it does nothing.
+func WithPipeBufferSize(n int) Option {
+	return func(o *options) {
+		o.pipeSize = n
+	}
+}
+
+// resizePipe applies WithPipeBufferSize to the pipe f.
+func (o *options) resizePipe(f *os.File) {
+	if o.pipeSize <= 0 {
+		return
+	}
+	if err := setPipeSize(f, o.pipeSize); err != nil {
+		o.logf("resizing the pipe to %d bytes: %v", o.pipeSize, err)
+	}
+}
+
+// WithSignalChannel hands the signals the package would otherwise handle
+// while the pager runs to ch instead, for programs that dispatch signals
+// themselves: SIGINT, which is then neither ignored nor forwarded to the
+// pager, SIGWINCH and SIGCONT. As with signal.Notify, signals are dropped
+// rather than block if ch isn't ready for them. SIGINT typed at the terminal
+// still reaches the pager, which runs in the program's process group. It
+// overrides WithForwardInterrupt; WithNoSignalHandling overrides it.
+func WithSignalChannel(ch chan<- os.Signal) Option {
+	return func(o *options) {
+		o.signalChan = ch
+	}
+}
+
+// WithArgv0 sets argv[0], the name the pager is started under, to argv0. By
+// default it's the base name of the pager's path, such as "less" whether
+// PAGER says less or /usr/bin/less, and "pager" for Debian's pager
+// alternative, for pagers that look at the name they were invoked as.
+func WithArgv0(argv0 string) Option {
+	return func(o *options) {
+		o.argv0 = argv0
+	}
+}
+
+// WithNoPagerValues sets the values of the pager variable, PAGER or the
+// first set one of WithEnvPrecedence, that mean no paging at all, in place of
+// cat and the empty string. Values must match exactly, so a variable of
+// nothing but whitespace is still treated as unset, as is an empty one with
+// no values given.
+func WithNoPagerValues(values ...string) Option {
+	return func(o *options) {
+		o.noPagerValues = append([]string{}, values...)
+	}
+}
+
+// WithAlwaysStayOpen keeps less open even when the output fits on one
+// screen, by leaving F out of the package's default LESS, so that the pager
+// behaves the same whatever the length of the output. Like WithLongPrompt, it
+// has no effect if the user has set LESS, or with WithRawLessEnv. Nor does it
+// stop WithAutoPage writing output that fits straight to stdout.
+func WithAlwaysStayOpen(stay bool) Option {
+	return func(o *options) {
+		o.alwaysStayOpen = stay
+	}
+}
+
+// WithLineFlush makes the writer WrapWriter returns flush the writer it
+// wraps after each newline, so that streamed output written to it, before or
+// instead of a pager, shows up a line at a time rather than when a buffer
+// fills. The wrapped writer is flushed with its Flush method, if it has one.
+// Output written to a pager, whether through Page, WrapWriter or the
+// redirected stdout and stderr of Open, needs no flushing: it goes straight
+// into the pager's pipe, so less shows each line, even with +F, as soon as
+// it's written.
+func WithLineFlush(flush bool) Option {
+	return func(o *options) {
+		o.lineFlush = flush
+	}
+}
+
+// WithStdoutPager makes Open page stdout through name, run with args, in place
+// of the pager it would choose, leaving stderr alone, as WithPager does
+// together with WithStreams(StdoutOnly).
+//
+// Given together with WithStderrPager, Open starts two pagers instead of one,
+// each reading one stream from a pipe of its own, and Close waits for both:
+// first for the stdout pager, then for the stderr one. Both draw on the same
+// terminal, so only the stdout pager should be interactive, like less; the
+// stderr one should just write what it reads, like a scrolling tail, since
+// it's given none of the terminal handling of WithSetpgid and WithPTY, nor
+// any signal handling. Output to the two streams no longer reaches a single
+// pager in the order it was written. Without both options, Open starts a
+// single pager as usual.
+func WithStdoutPager(name string, args ...string) Option {
+	return func(o *options) {
+		o.stdoutPager = append([]string{name}, args...)
+	}
+}
+
+// WithStderrPager makes Open page stderr through name, run with args, in place
+// of the pager it would choose, leaving stdout alone. See WithStdoutPager for
+// giving both.
+func WithStderrPager(name string, args ...string) Option {
+	return func(o *options) {
+		o.stderrPager = append([]string{name}, args...)
+	}
+}
+
+// WithCapture mirrors everything written to the pager into w, for example to
+// attach it to a bug report. w is written to from another goroutine, and has
+// seen all of the output by the time Close returns. Errors writing to w are
+// ignored.
+func WithCapture(w io.Writer) Option {
+	return func(o *options) {
+		o.capture = w
+	}
+}
+
+// argv returns the arguments to start the candidate c, found at path, with.
+func (o *options) argv(path string, c candidate) []string {
+	// argv[0] is as typed in PAGER, or a fallback's bare name; make it the
+	// same whichever way the pager was found.
+	argv0 := o.argv0
+	if argv0 == "" {
+		argv0 = filepath.Base(path)
+	}
+	argv := append([]string{argv0}, c.args[1:]...)
+	if !isLess(path) {
+		return argv
+	}
+	if o.noInitialClear {
+		argv = addFlag(argv, "-X")
+	}
+	if o.lineNumbers {
+		argv = addFlag(argv, "-N")
+	}
+	if len(o.versionedFlags) > 0 && !o.noVersionProbe {
+		v := lessVersion(path)
+		for _, f := range o.versionedFlags {
+			if v >= f.minVersion {
+				argv = addFlag(argv, f.flag)
+			}
+		}
+	}
+	if o.prompt != "" {
+		// Set the short, medium and long prompts since LESS may select any
+		// of them.
+		prompt := lessPromptEscaper.Replace(o.prompt)
+		argv = append(argv[:len(argv):len(argv)],
+			"-Ps"+prompt, "-Pm"+prompt, "-PM"+prompt)
+	}
+	return argv
+}
+
+// isLess reports whether the pager at path is less, following symlinks such as
+// Debian's pager alternative.
+func isLess(path string) bool {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	return filepath.Base(path) == "less"
+}
+
+// addFlag returns argv with flag appended, unless it's there already, without
+// changing argv itself.
+func addFlag(argv []string, flag string) []string {
+	for _, arg := range argv[1:] {
+		if arg == flag {
+			return argv
+		}
+	}
+	return append(argv[:len(argv):len(argv)], flag)
+}
+
+// lessPromptEscaper escapes the characters that are special in less prompts.
+var lessPromptEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`?`, `\?`,
+	`:`, `\:`,
+	`.`, `\.`,
+	`%`, `\%`,
+)
+
+// useStreamPager makes the pager given by WithStdoutPager, or else by
+// WithStderrPager, the only one to try, paging just its stream.
+func (o *options) useStreamPager() {
+	switch {
+	case o.stdoutPager != nil:
+		o.pager, o.streams = o.stdoutPager, StdoutOnly
+	case o.stderrPager != nil:
+		o.pager, o.streams = o.stderrPager, StderrOnly
+	}
+}
@@ -0,0 +1,487 @@
+// Copyright 2019 Mike Gerow
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pager
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"unicode/utf8"
+
+	"golang.org/x/sys/unix"
+)
+
+// Page starts a pager and calls f with a writer that feeds it, closing the
+// pager once f returns. Output reaches the pager as f writes it, and writes
+// block while the pager isn't reading, so even very large outputs never need
+// to be held in memory. Unlike Open, stdout and stderr are left alone, and
+// SIGINT is handled as before once Page returns.
+//
+// If Open wouldn't start a pager, f is called with os.Stdout instead. Page
+// returns the error from f if there is one, or else the error from closing
+// the pager.
+//
+// With WithAutoPage, the pager is only started once the output no longer
+// fits on the screen, with WithAutoPageThreshold once enough has been written
+// to the terminal, and with WithLazySpawn at the first write.
+func Page(f func(w io.Writer) error, opts ...Option) error {
+	o := newOptions(opts)
+	if o.autoPage || o.lazySpawn || o.pageThreshold > 0 {
+		if !shouldPage(o) {
+			return f(os.Stdout)
+		}
+		a := &autoWriter{o: o, out: os.Stdout}
+		a.rows, a.cols = screenSize(o.ttyFD())
+		ferr := f(a)
+		if err := a.Close(); ferr == nil {
+			ferr = err
+		}
+		return ferr
+	}
+
+	p, err := start(o)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		return f(os.Stdout)
+	}
+	p.beginScoped()
+	ferr := f(p.writer())
+	if err := p.close(); ferr == nil {
+		ferr = err
+	}
+	return ferr
+}
+
+// PageEnd is what ended a session started by PageFrom or PageCommand.
+type PageEnd int
+
+const (
+	// SourceEOF means the source was read to the end, or the command
+	// exited, after which the user quit the pager.
+	SourceEOF PageEnd = iota
+	// PagerExited means the pager exited, typically because the user quit
+	// it, before the source was read to the end, or while the command was
+	// still running, which was then terminated.
+	PagerExited
+)
+
+// PageFrom starts a pager and copies r to it until r reaches EOF, then waits
+// for the user to quit the pager. If the pager exits first, PageFrom returns
+// without reading the rest of r, so a pipeline tool stops once the user has
+// seen enough. It returns which of the two ended the session. As with Page,
+// stdout and stderr are left alone, and r is copied to os.Stdout if Open
+// wouldn't start a pager.
+//
+// A Read from r that's blocked when the pager exits is left to return in the
+// background, and what it read is dropped.
+func PageFrom(r io.Reader, opts ...Option) (PageEnd, error) {
+	p, err := start(newOptions(opts))
+	if err != nil {
+		return SourceEOF, err
+	}
+	if p == nil {
+		_, err := io.Copy(os.Stdout, r)
+		return SourceEOF, err
+	}
+	p.beginScoped()
+	copied := make(chan error, 1)
+	go func(w io.Writer) {
+		_, err := io.Copy(w, r)
+		copied <- err
+	}(p.writer())
+	end := SourceEOF
+	select {
+	case err = <-copied:
+	case <-p.exited:
+		end = PagerExited
+	}
+	if end == SourceEOF && errors.Is(err, ErrPagerClosed) {
+		// The pager exited while being written to.
+		end, err = PagerExited, nil
+	}
+	if cerr := p.close(); err == nil {
+		err = cerr
+	}
+	return end, err
+}
+
+// PageCommand runs cmd with its stdout and stderr both going to a new pager,
+// the way git pages the output of its commands, and waits for cmd to exit
+// and then for the user to quit the pager. If the user quits the pager while
+// cmd is still running, cmd is sent SIGTERM so that it stops producing output
+// no one will read, and PageCommand returns PagerExited once it has exited.
+// How cmd exits then isn't reported as an error, and nor is cmd dying of
+// SIGPIPE from writing to the pager after it was quit. A cmd that ignores
+// SIGTERM and writes nothing more keeps PageCommand waiting. As with Page, if
+// Open wouldn't start a pager, cmd's output goes to stdout and stderr, or
+// wherever cmd.Stdout and cmd.Stderr already point.
+//
+// It returns the error from running cmd if there is one, or else the error
+// from closing the pager.
+func PageCommand(cmd *exec.Cmd, opts ...Option) (PageEnd, error) {
+	p, err := start(newOptions(opts))
+	if err != nil {
+		return SourceEOF, err
+	}
+	if p == nil {
+		if cmd.Stdout == nil {
+			cmd.Stdout = os.Stdout
+		}
+		if cmd.Stderr == nil {
+			cmd.Stderr = os.Stderr
+		}
+		return SourceEOF, cmd.Run()
+	}
+	// SIGINT is caught rather than ignored now, so cmd doesn't inherit it
+	// as ignored.
+	p.beginScoped()
+	cmd.Stdout, cmd.Stderr = p.pw, p.pw
+	if err := cmd.Start(); err != nil {
+		p.quit()
+		p.close()
+		return SourceEOF, err
+	}
+	done := make(chan struct{})
+	terminated := make(chan bool, 1)
+	go func() {
+		select {
+		case <-p.exited:
+			// The user has quit, so there's no one to read the rest.
+			terminated <- cmd.Process.Signal(syscall.SIGTERM) == nil
+		case <-done:
+			terminated <- false
+		}
+	}()
+	err = cmd.Wait()
+	close(done)
+	end := SourceEOF
+	if <-terminated {
+		end, err = PagerExited, nil
+	} else if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() && ws.Signal() == syscall.SIGPIPE {
+		// The pager stopped reading.
+		end, err = PagerExited, nil
+	}
+	if cerr := p.close(); err == nil {
+		err = cerr
+	}
+	return end, err
+}
+
+// WrapWriter returns a writer that starts a pager the first time it's written
+// to, and from then on feeds it, so that a library that writes to w pages
+// only when there is output. Close waits for the pager to exit. If Open
+// wouldn't start a pager, or none is found, writes go to w instead. As with
+// Page, stdout and stderr are left alone. The writer isn't safe for
+// concurrent use.
+//
+// With WithAutoPage, output is held back until it no longer fits on the
+// screen, and written to w by Close if it never does. With
+// WithAutoPageThreshold, output goes to w until the threshold is reached.
+//
+// With WithLineFlush, a w with a Flush method, like a bufio.Writer, is
+// flushed after each write to it that contains a newline.
+//
+// The error is from checking opts, such as fallback names, upfront; errors
+// starting the pager are returned from the first Write.
+func WrapWriter(w io.Writer, opts ...Option) (io.WriteCloser, error) {
+	o := newOptions(opts)
+	if _, err := candidates(o); err != nil {
+		return nil, err
+	}
+	w = o.lineFlushed(w)
+	if !shouldPage(o) {
+		return nopCloser{w}, nil
+	}
+	a := &autoWriter{o: o, out: w}
+	if o.autoPage {
+		a.rows, a.cols = screenSize(o.ttyFD())
+	}
+	return a, nil
+}
+
+// lineFlushed returns w wrapped to be flushed after each line, if
+// WithLineFlush is set and w can be flushed.
+func (o *options) lineFlushed(w io.Writer) io.Writer {
+	f, ok := w.(interface{ Flush() error })
+	if !o.lineFlush || !ok {
+		return w
+	}
+	return &lineFlusher{w: w, flush: f.Flush}
+}
+
+// lineFlusher calls flush after each write to w that contains a newline.
+type lineFlusher struct {
+	w     io.Writer
+	flush func() error
+}
+
+func (l *lineFlusher) Write(b []byte) (int, error) {
+	n, err := l.w.Write(b)
+	if err == nil && bytes.IndexByte(b[:n], '\n') >= 0 {
+		err = l.flush()
+	}
+	return n, err
+}
+
+// nopCloser adds a Close that does nothing to a writer.
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// ErrPagerClosed is returned by writes through the writers of Page and
+// WrapWriter once the pager has exited, typically because the user quit it,
+// so that the program can stop producing output.
+var ErrPagerClosed = errors.New("pager: pager closed")
+
+// beginScoped begins a session for Page and the others here. Unlike Open they
+// end it before returning, so SIGINT is put back as it was then too.
+func (p *pgr) beginScoped() {
+	p.scoped = true
+	p.begin()
+}
+
+// writer returns the writer the Page callback writes to.
+func (p *pgr) writer() io.Writer {
+	var w io.Writer = &pipeWriter{pw: p.pw, exited: p.exited}
+	if abort := p.opts.abortOnWriteError; abort != nil {
+		w = &abortWriter{w: w, abort: abort}
+	}
+	return w
+}
+
+// pipeWriter writes to the pager's pipe pw, failing with ErrPagerClosed once
+// the pager has exited. A write racing with the pager's exit may still reach
+// the pipe, but then fails with EPIPE, which is reported the same way.
+type pipeWriter struct {
+	pw     *os.File
+	exited <-chan struct{}
+}
+
+func (w *pipeWriter) Write(b []byte) (int, error) {
+	select {
+	case <-w.exited:
+		return 0, ErrPagerClosed
+	default:
+	}
+	n, err := w.pw.Write(b)
+	if errors.Is(err, unix.EPIPE) {
+		err = ErrPagerClosed
+	}
+	return n, err
+}
+
+// abortWriter calls abort with the first error writing to w.
+type abortWriter struct {
+	w     io.Writer
+	abort func(error)
+	once  sync.Once
+}
+
+func (a *abortWriter) Write(b []byte) (int, error) {
+	n, err := a.w.Write(b)
+	if err != nil {
+		a.once.Do(func() { a.abort(err) })
+	}
+	return n, err
+}
+
+// autoWriter holds output back while it fits on a screen of rows by cols,
+// with WithAutoPage, and starts a pager for it once it doesn't. Without
+// WithAutoPage the pager starts at the first write.
+type autoWriter struct {
+	o          *options
+	rows, cols int
+	buf        bytes.Buffer
+	// out is where output goes if no pager is started.
+	out io.Writer
+	// w is where output goes once it's been decided, and p the pager
+	// started for it, if any.
+	w io.Writer
+	p *pgr
+	// streamed is how much was written to out before the pager started,
+	// with WithAutoPageThreshold.
+	streamed int
+	// closed is set by the first Close, which later ones leave alone.
+	closed bool
+}
+
+func (a *autoWriter) Write(b []byte) (int, error) {
+	if a.w != nil {
+		return a.w.Write(b)
+	}
+	if a.o.pageThreshold > 0 {
+		return a.stream(b)
+	}
+	a.buf.Write(b)
+	if a.o.autoPage && a.o.fits(a.buf.Bytes(), a.rows, a.cols) {
+		return len(b), nil
+	}
+	if err := a.start(); err != nil {
+		return 0, err
+	}
+	if _, err := a.w.Write(a.buf.Bytes()); err != nil {
+		return 0, err
+	}
+	a.buf.Reset()
+	return len(b), nil
+}
+
+// stream writes b to out up to WithAutoPageThreshold, and to a pager from
+// there on.
+func (a *autoWriter) stream(b []byte) (int, error) {
+	n := 0
+	if left := a.o.pageThreshold - a.streamed; left > 0 {
+		head := b
+		if len(head) > left {
+			head = head[:left]
+		}
+		var err error
+		n, err = a.out.Write(head)
+		a.streamed += n
+		if err != nil || n == len(b) {
+			return n, err
+		}
+	}
+	if err := a.start(); err != nil {
+		return n, err
+	}
+	m, err := a.w.Write(b[n:])
+	return n + m, err
+}
+
+// start starts the pager, or settles on out if none is started.
+func (a *autoWriter) start() error {
+	p, err := start(a.o)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		a.w = a.out
+	} else {
+		p.beginScoped()
+		a.w, a.p = p.writer(), p
+	}
+	return nil
+}
+
+// Close writes out output that fit on the screen, or closes the pager. Calls
+// after the first do nothing.
+func (a *autoWriter) Close() error {
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+	if a.p != nil {
+		return a.p.close()
+	}
+	if a.w == nil {
+		_, err := a.out.Write(a.buf.Bytes())
+		a.buf.Reset()
+		return err
+	}
+	return nil
+}
+
+// screenSize returns the size of the terminal on fd, or zeroes if it can't be
+// found.
+func screenSize(fd int) (rows, cols int) {
+	ws, err := unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ)
+	if err != nil {
+		return 0, 0
+	}
+	return int(ws.Row), int(ws.Col)
+}
+
+// fitsScreen reports whether buf, written to a terminal of rows by cols,
+// would leave a row free for the shell's prompt. It accounts for long lines
+// wrapping, tab stops and ANSI escape sequences, but takes every other
+// printable character to be one column wide.
+func fitsScreen(buf []byte, rows, cols int) bool {
+	if rows <= 0 || cols <= 0 {
+		return false
+	}
+	used, col := 0, 0
+	for i := 0; i < len(buf) && used < rows; {
+		r, size := utf8.DecodeRune(buf[i:])
+		i += size
+		switch {
+		case r == '\n':
+			used++
+			col = 0
+		case r == '\r':
+			col = 0
+		case r == '\t':
+			// Tabs stop at the last column rather than wrap.
+			if col = (col/8 + 1) * 8; col > cols {
+				col = cols
+			}
+		case r == 0x1b:
+			i += escapeLen(buf[i:])
+		case r < 0x20 || r == 0x7f:
+		default:
+			// Terminals only wrap when a character is written past the
+			// last column.
+			if col == cols {
+				used++
+				col = 0
+			}
+			col++
+		}
+	}
+	if col > 0 {
+		used++
+	}
+	return used < rows
+}
+
+// escapeLen returns the length of the escape sequence at the start of b,
+// which follows an ESC.
+func escapeLen(b []byte) int {
+	if len(b) == 0 {
+		return 0
+	}
+	switch b[0] {
+	case '[':
+		// CSI sequences end with a byte in the range @ to ~.
+		for i := 1; i < len(b); i++ {
+			if b[i] >= 0x40 && b[i] <= 0x7e {
+				return i + 1
+			}
+		}
+		return len(b)
+	case ']':
+		// OSC sequences end with BEL or ESC \.
+		for i := 1; i < len(b); i++ {
+			if b[i] == 0x07 {
+				return i + 1
+			}
+			if b[i] == 0x1b && i+1 < len(b) && b[i+1] == '\\' {
+				return i + 2
+			}
+		}
+		return len(b)
+	}
+	return 1
+}
@@ -0,0 +1,485 @@
+// Copyright 2019 Mike Gerow
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pager
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPage(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	testPager(t, "cat >"+out)
+	err := Page(func(w io.Writer) error {
+		if IsRedirected() {
+			t.Error("stdout redirected during Page")
+		}
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "%d hello from my pager!\n", i)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = "0 hello from my pager!\n1 hello from my pager!\n2 hello from my pager!\n"
+	if got, err := os.ReadFile(out); err != nil || string(got) != want {
+		t.Errorf("pager read %q, %v, want %q", got, err, want)
+	}
+}
+
+func TestPageError(t *testing.T) {
+	testPager(t, "cat >/dev/null")
+	want := errors.New("failed")
+	if err := Page(func(io.Writer) error { return want }); err != want {
+		t.Errorf("Page = %v, want %v", err, want)
+	}
+}
+
+func TestAbortOnWriteError(t *testing.T) {
+	testPager(t, "exit 0")
+	var aborted error
+	err := Page(func(w io.Writer) error {
+		// Keep writing until the pager has gone.
+		for {
+			if _, err := fmt.Fprintln(w, "hello from my pager!"); err != nil {
+				return nil
+			}
+		}
+	}, WithAbortOnWriteError(func(err error) { aborted = err }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aborted == nil {
+		t.Error("abort hook not called after the pager quit")
+	}
+}
+
+func TestPagerClosed(t *testing.T) {
+	testPager(t, "exit 0")
+	err := Page(func(w io.Writer) error {
+		// Keep writing until the pager has gone.
+		for {
+			if _, err := fmt.Fprintln(w, "hello from my pager!"); err != nil {
+				return err
+			}
+		}
+	})
+	if err != ErrPagerClosed {
+		t.Errorf("Page = %v, want %v", err, ErrPagerClosed)
+	}
+}
+
+func TestFitsScreen(t *testing.T) {
+	for _, tt := range []struct {
+		buf        string
+		rows, cols int
+		want       bool
+	}{
+		{"", 3, 10, true},
+		{"a\nb\n", 3, 10, true},
+		{"a\nb\nc\n", 3, 10, false},
+		// Exactly filling a row doesn't wrap, one more character does.
+		{strings.Repeat("x", 10) + "\n", 2, 10, true},
+		{strings.Repeat("x", 11) + "\n", 2, 10, false},
+		{strings.Repeat("x", 25), 4, 10, true},
+		{strings.Repeat("x", 25), 3, 10, false},
+		// Escape sequences and tabs take no and several columns.
+		{"\x1b[1;31m" + strings.Repeat("x", 10) + "\x1b[0m\n", 2, 10, true},
+		{"\x1b]0;title\x07abc\n", 2, 10, true},
+		{"\t\tx\n", 2, 16, false},
+		{"\t\t\t\n", 2, 16, true},
+		{"héllo\n", 2, 5, true},
+		{"anything", 0, 0, false},
+	} {
+		if got := fitsScreen([]byte(tt.buf), tt.rows, tt.cols); got != tt.want {
+			t.Errorf("fitsScreen(%q, %d, %d) = %v, want %v", tt.buf, tt.rows, tt.cols, got, tt.want)
+		}
+	}
+}
+
+func TestAutoPage(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	testPager(t, "cat >"+out)
+	fits := func(buf []byte, rows, cols int) bool {
+		return strings.Count(string(buf), "\n") < 3
+	}
+	page := func(lines int) {
+		t.Helper()
+		err := Page(func(w io.Writer) error {
+			for i := 0; i < lines; i++ {
+				fmt.Fprintf(w, "%d\n", i)
+			}
+			return nil
+		}, WithAutoPage(true), WithFitCalculator(fits))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	page(5)
+	if got, err := os.ReadFile(out); err != nil || string(got) != "0\n1\n2\n3\n4\n" {
+		t.Errorf("pager read %q, %v, want all the output", got, err)
+	}
+	os.Remove(out)
+	// Output that fits goes to stdout.
+	devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devnull.Close()
+	stdout := os.Stdout
+	os.Stdout = devnull
+	defer func() { os.Stdout = stdout }()
+	page(2)
+	if _, err := os.Stat(out); err == nil {
+		t.Error("pager started for output that fit")
+	}
+}
+
+func TestWrapWriter(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	testPager(t, "cat >"+out)
+	var w bytes.Buffer
+	pw, err := WrapWriter(&w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(out); err == nil {
+		t.Error("pager started before the first write")
+	}
+	fmt.Fprint(pw, "hello ")
+	fmt.Fprint(pw, "from my pager!\n")
+	if err := pw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(out); err != nil || string(got) != "hello from my pager!\n" {
+		t.Errorf("pager read %q, %v, want all the output", got, err)
+	}
+	if w.Len() != 0 {
+		t.Errorf("wrapped writer got %q while paging", w.String())
+	}
+
+	// Output that fits goes to the wrapped writer.
+	os.Remove(out)
+	fits := func(buf []byte, rows, cols int) bool { return true }
+	pw, err = WrapWriter(&w, WithAutoPage(true), WithFitCalculator(fits))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(pw, "short\n")
+	if err := pw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.String(); got != "short\n" {
+		t.Errorf("wrapped writer got %q, want %q", got, "short\n")
+	}
+	if _, err := os.Stat(out); err == nil {
+		t.Error("pager started for output that fit")
+	}
+}
+
+func TestLineFlush(t *testing.T) {
+	testPager(t, "cat >/dev/null")
+	isTerminal = func(uintptr) bool { return false }
+	var term bytes.Buffer
+	bw := bufio.NewWriter(&term)
+	w, err := WrapWriter(bw, WithLineFlush(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ write, want string }{
+		{"hello", ""},
+		{" from my pager!\nmore", "hello from my pager!\nmore"},
+		{" to come", "hello from my pager!\nmore"},
+	} {
+		io.WriteString(w, tc.write)
+		if got := term.String(); got != tc.want {
+			t.Errorf("after writing %q the terminal got %q, want %q", tc.write, got, tc.want)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLazySpawn(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	testPager(t, "cat >"+out)
+	if err := Page(func(w io.Writer) error { return nil }, WithLazySpawn(true)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(out); err == nil {
+		t.Error("pager started for a callback that wrote nothing")
+	}
+	err := Page(func(w io.Writer) error {
+		_, err := fmt.Fprint(w, "hello from my pager!\n")
+		return err
+	}, WithLazySpawn(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(out); err != nil || string(got) != "hello from my pager!\n" {
+		t.Errorf("pager read %q, %v, want the output", got, err)
+	}
+}
+
+func TestAutoPageThreshold(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	testPager(t, "cat >"+out)
+	var term bytes.Buffer
+	w, err := WrapWriter(&term, WithAutoPageThreshold(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"hello", " from my", " pager!\n"} {
+		if n, err := io.WriteString(w, s); n != len(s) || err != nil {
+			t.Fatalf("Write(%q) = %d, %v", s, n, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := term.String(), "hello fr"; got != want {
+		t.Errorf("terminal got %q, want %q", got, want)
+	}
+	if got, err := os.ReadFile(out); err != nil || string(got) != "om my pager!\n" {
+		t.Errorf("pager read %q, %v, want the rest", got, err)
+	}
+}
+
+func TestPagerStderr(t *testing.T) {
+	testPager(t, "echo oops >&2; cat >/dev/null")
+	f, err := os.Create(filepath.Join(t.TempDir(), "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := Page(func(w io.Writer) error { return nil }, WithPagerStderr(f)); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(f.Name()); err != nil || string(got) != "oops\n" {
+		t.Errorf("pager stderr got %q, %v, want %q", got, err, "oops\n")
+	}
+}
+
+func TestPagerDiagnostics(t *testing.T) {
+	testPager(t, "echo oops >&2; cat >/dev/null")
+	var diag bytes.Buffer
+	if err := Page(func(w io.Writer) error { return nil }, WithPagerDiagnostics(&diag)); err != nil {
+		t.Fatal(err)
+	}
+	if got := diag.String(); got != "oops\n" {
+		t.Errorf("pager diagnostics got %q, want %q", got, "oops\n")
+	}
+}
+
+func TestFooter(t *testing.T) {
+	testPager(t, "cat >/dev/null")
+	f, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	stdout := os.Stdout
+	os.Stdout = f
+	defer func() { os.Stdout = stdout }()
+	page := func(opts ...Option) {
+		t.Helper()
+		err := Page(func(w io.Writer) error {
+			_, err := fmt.Fprint(w, "paged\n")
+			return err
+		}, append(opts, WithFooter("bye\n"))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	page()
+	// Without a pager the output goes to stdout, with no footer.
+	page(WithFallbacks(), WithEnvPrecedence(), WithQuiet(true))
+	if got, err := os.ReadFile(f.Name()); err != nil || string(got) != "bye\npaged\n" {
+		t.Errorf("stdout got %q, %v, want %q", got, err, "bye\npaged\n")
+	}
+}
+
+func TestReplayOnExit(t *testing.T) {
+	testPager(t, "cat >/dev/null")
+	f, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	stdout := os.Stdout
+	os.Stdout = f
+	defer func() { os.Stdout = stdout }()
+	err = Page(func(w io.Writer) error {
+		_, err := fmt.Fprint(w, "paged\n")
+		return err
+	}, WithReplayOnExit(true), WithFooter("bye\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(f.Name()); err != nil || string(got) != "paged\nbye\n" {
+		t.Errorf("stdout got %q, %v, want %q", got, err, "paged\nbye\n")
+	}
+}
+
+func TestPageFromEOF(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	testPager(t, "cat >"+out)
+	const want = "hello from my pager!\n"
+	end, err := PageFrom(strings.NewReader(want))
+	if err != nil || end != SourceEOF {
+		t.Fatalf("PageFrom = %v, %v, want %v, nil", end, err, SourceEOF)
+	}
+	if got, err := os.ReadFile(out); err != nil || string(got) != want {
+		t.Errorf("pager read %q, %v, want %q", got, err, want)
+	}
+}
+
+func TestPageFromPagerExited(t *testing.T) {
+	testPager(t, "exit 0")
+	// The source never ends, so only the pager exiting can end the session.
+	r, w := io.Pipe()
+	defer w.Close()
+	end, err := PageFrom(r)
+	if err != nil || end != PagerExited {
+		t.Fatalf("PageFrom = %v, %v, want %v, nil", end, err, PagerExited)
+	}
+}
+
+func TestPagerForce(t *testing.T) {
+	dir := t.TempDir()
+	script, out := filepath.Join(dir, "pager"), filepath.Join(dir, "out")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\ncat >\"$1\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Whatever test runs this, stdout isn't taken to be a terminal.
+	old := isTerminal
+	isTerminal = func(uintptr) bool { return false }
+	defer func() { isTerminal = old }()
+	setenv(t, "PAGER", "more")
+	err := Page(func(w io.Writer) error {
+		_, err := fmt.Fprint(w, "hello from my pager!\n")
+		return err
+	}, WithPager(script, out), WithForce(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(out); err != nil || string(got) != "hello from my pager!\n" {
+		t.Errorf("pager read %q, %v, want the output", got, err)
+	}
+}
+
+func TestPageCommand(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	testPager(t, "cat >"+out)
+	cmd := exec.Command("sh", "-c", "echo out; echo err >&2")
+	if end, err := PageCommand(cmd); err != nil || end != SourceEOF {
+		t.Fatalf("PageCommand = %v, %v, want %v, nil", end, err, SourceEOF)
+	}
+	if got, err := os.ReadFile(out); err != nil || string(got) != "out\nerr\n" {
+		t.Errorf("pager read %q, %v, want both streams", got, err)
+	}
+	var exitErr *exec.ExitError
+	if _, err := PageCommand(exec.Command("sh", "-c", "exit 3")); !errors.As(err, &exitErr) {
+		t.Errorf("PageCommand of a failing command = %v, want an *exec.ExitError", err)
+	}
+}
+
+func TestPageCommandPagerQuit(t *testing.T) {
+	testPager(t, "exit 0")
+	start := time.Now()
+	// The command writes nothing, so only SIGTERM ends it early.
+	end, err := PageCommand(exec.Command("sleep", "10"))
+	if err != nil || end != PagerExited {
+		t.Fatalf("PageCommand = %v, %v, want %v, nil", end, err, PagerExited)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("command ran for %v after the pager quit", d)
+	}
+}
+
+func TestPageRestoresInterrupt(t *testing.T) {
+	testPager(t, "cat >/dev/null")
+	defaultInterrupt()
+	sessions := map[string]func() error{
+		"Page": func() error {
+			return Page(func(w io.Writer) error {
+				_, err := fmt.Fprint(w, "paged\n")
+				return err
+			})
+		},
+		"PageFrom": func() error {
+			_, err := PageFrom(strings.NewReader("paged\n"))
+			return err
+		},
+		"PageCommand": func() error {
+			_, err := PageCommand(exec.Command("echo", "paged"))
+			return err
+		},
+		"WrapWriter": func() error {
+			w, err := WrapWriter(os.Stdout)
+			if err != nil {
+				return err
+			}
+			fmt.Fprint(w, "paged\n")
+			return w.Close()
+		},
+	}
+	for name, page := range sessions {
+		if err := page(); err != nil {
+			t.Errorf("%s = %v", name, err)
+		}
+		if signal.Ignored(os.Interrupt) {
+			t.Errorf("SIGINT ignored after %s returned", name)
+		}
+	}
+}
+
+func TestWrapWriterCloseTwice(t *testing.T) {
+	testPager(t, "cat >/dev/null")
+	f, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	stdout := os.Stdout
+	os.Stdout = f
+	defer func() { os.Stdout = stdout }()
+	pw, err := WrapWriter(io.Discard, WithFooter("bye\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(pw, "paged\n")
+	for i := 0; i < 2; i++ {
+		if err := pw.Close(); err != nil {
+			t.Fatalf("Close %d = %v, want nil", i+1, err)
+		}
+	}
+	if got, err := os.ReadFile(f.Name()); err != nil || string(got) != "bye\n" {
+		t.Errorf("stdout got %q, %v, want the footer once", got, err)
+	}
+}
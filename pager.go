@@ -19,11 +19,20 @@
 package pager
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/mattn/go-isatty"
 	"golang.org/x/sys/unix"
@@ -31,154 +40,1628 @@ import (
 
 // Open sets up the environment to be paged to a pager found on the system if
 // the current stdout/stderr is a non-dumb terminal. It uses the value of the
-// environment "PAGER" first. If that isn't set it attempts to use "pager",
-// "less", and "more" in that order. If no suitable pager is found Open still
-// returns without error but no pager is setup.
+// environment "PAGER" first, split with shell quoting rules, or of the
+// variables given by WithEnvPrecedence. If that isn't set it attempts to use
+// the pagers WithContentTypePagers gives for the WithContentType type, if
+// any, then the pagers in DefaultFallbacks, "pager", "less", and "more" in
+// that order, or the ones given by WithFallbacks. Those fallbacks are passed
+// the arguments in the environment "PAGER_DEFAULT_ARGS", split the same way.
+// A pager returned by the WithPagerProvider provider is tried before all of
+// these. If no suitable pager is found Open still returns without error but
+// no pager is setup.
 //
-// If stdout/stderr is a dumb terminal Open does nothing.
+// If stdout/stderr is a dumb terminal Open does nothing, unless
+// WithPageDumbTerminals is given. Nor does it if /dev/tty can't be opened, as
+// without a controlling terminal, since the pager couldn't read keystrokes.
+//
+// As in git, PAGER=cat and a PAGER set but empty mean no paging at all: Open
+// returns without starting anything or redirecting output. WithNoPagerValues
+// changes which values do this. Any other pager named cat, as with
+// PAGER=/bin/cat, is taken to mean that output should reach the terminal
+// unpaged but through the same pipe. It is started without
+// the terminal handling of WithSetpgid and WithPTY, and SIGINT isn't ignored
+// while it runs.
 //
 // After a call to Open subsequent writes to os.Stdout and os.Stderr will be
 // redirected to a pager.
 //
+// Stdout and stderr are redirected at the file descriptor level to the same
+// pipe, so their output reaches the pager in the order it was written. A
+// single write of up to PIPE_BUF bytes, 4096 on Linux, is never split up by
+// another. Writes through the same *os.File are serialized by the runtime,
+// but writes to os.Stdout and os.Stderr larger than that may interleave,
+// unless WithSerializedWrites is given.
+//
 // Note that Close must be called after an open in order for the pager to be
 // closed correctly. This should generally be done using a defer.
-func Open() error {
-	var err error
-	p, err = open()
+//
+// Open and Close nest: if a pager is already running, Open reuses it, ignoring
+// opts, and it takes a call to Close for each call to Open to close it. So a
+// subcommand can Open and Close around its output without closing the pager
+// its caller opened, while an unmatched Open leaves the pager running to the
+// end of the program. Quit and Reset end the pager whatever the count.
+func Open(opts ...Option) error {
+	_, err := EnsureOpen(opts...)
 	return err
 }
 
+// OpenContext is like Open, but also returns a context derived from parent
+// that is cancelled once the pager exits, typically because the user quit it,
+// so that work producing output for the pager can stop. If no pager is
+// started the returned context is parent itself.
+func OpenContext(parent context.Context, opts ...Option) (context.Context, error) {
+	if err := Open(opts...); err != nil {
+		return parent, err
+	}
+	s := current()
+	if s == nil {
+		return parent, nil
+	}
+	ctx, cancel := context.WithCancel(parent)
+	go func(exited <-chan struct{}) {
+		select {
+		case <-exited:
+		case <-ctx.Done():
+		}
+		cancel()
+	}(s.exited)
+	return ctx, nil
+}
+
+// OpenVerbose is like Open, but logs each step of choosing and starting the
+// pager to logger: which pagers it tries, why it skips any, and what it
+// starts, or why it doesn't page at all. It's meant for finding out why the
+// expected pager isn't used.
+func OpenVerbose(logger *log.Logger, opts ...Option) error {
+	return Open(append(opts[:len(opts):len(opts)], func(o *options) {
+		o.logger = logger
+	})...)
+}
+
+// EnsureOpen is like Open, but also reports whether it reused a pager that
+// was already running. It suits middleware that can't coordinate a single
+// call to Open. Each call to EnsureOpen must be paired with a call to Close.
+func EnsureOpen(opts ...Option) (reused bool, err error) {
+	lockSettled()
+	defer sessionMu.Unlock()
+	if p != nil {
+		p.refs++
+		return true, nil
+	}
+	if deferred != nil {
+		deferredRefs++
+		return true, nil
+	}
+	var s *pgr
+	s, err = open(newOptions(opts))
+	setCurrent(s)
+	return false, err
+}
+
+// OpenDeferred is like Open, but doesn't start the pager or redirect any
+// output until BeginPaging is called, so that a program can draw progress on
+// the terminal, for example with carriage returns, and only page the output
+// that follows. opts are checked up front, as fallback names are. Close must
+// still be called, and ends paging whether or not BeginPaging was.
+//
+// While paging is pending, Open, EnsureOpen and OpenDeferred nest in it as
+// they do in a running pager: they start nothing, ignoring opts, and it takes
+// a call to Close for each of them before Close cancels the pending paging.
+func OpenDeferred(opts ...Option) error {
+	o := newOptions(opts)
+	if _, err := candidates(o); err != nil {
+		return err
+	}
+	lockSettled()
+	defer sessionMu.Unlock()
+	if p != nil {
+		p.refs++
+		return nil
+	}
+	if deferred != nil {
+		deferredRefs++
+		return nil
+	}
+	deferred = o
+	return nil
+}
+
+// BeginPaging starts the pager OpenDeferred set up and redirects output to
+// it from then on. It does nothing if no paging is pending, as after Open.
+func BeginPaging() error {
+	lockSettled()
+	defer sessionMu.Unlock()
+	if deferred == nil || p != nil {
+		return nil
+	}
+	s, err := open(deferred)
+	if s != nil {
+		s.refs = deferredRefs
+	}
+	setCurrent(s)
+	deferred, deferredRefs = nil, 0
+	return err
+}
+
+// deferred holds the options of an OpenDeferred awaiting BeginPaging, and
+// deferredRefs how many more calls to Close it takes to cancel it, as refs
+// does for a running pager.
+var (
+	deferred     *options
+	deferredRefs int
+)
+
 // Close closes the pager. This call will block until the pager is exited.
+// If the pager was opened more than once, Close only closes it on the last
+// call, and returns nil before that.
 func Close() error {
-	err := p.close()
-	p = nil
+	lockSettled()
+	defer sessionMu.Unlock()
+	if deferred != nil {
+		if deferredRefs > 0 {
+			deferredRefs--
+		} else {
+			deferred = nil
+		}
+		return nil
+	}
+	if p == nil {
+		return nil
+	}
+	if p.refs > 0 {
+		p.refs--
+		return nil
+	}
+	return closeCurrent(false)
+}
+
+// RunPaged opens a pager as Open does, calls fn, whose output to stdout and
+// stderr goes to the pager, and closes it again. If fn or closing the pager
+// fails, it returns a *RunError telling the errors apart. An error from
+// opening the pager is returned as is, and fn isn't called then.
+//
+// If fn panics, the pager is ended as with Quit, without waiting for the user,
+// and stdout, stderr, the handling of signals and the terminal are put back
+// even if that fails, so that the panic reaches a usable terminal. The panic
+// then continues.
+func RunPaged(fn func() error, opts ...Option) (err error) {
+	if err := Open(opts...); err != nil {
+		return err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			s := current()
+			if Quit() != nil {
+				// close gives up at its first error, which may be
+				// before it got to the terminal.
+				s.restoreForeground()
+				restoreTermios(s.opts.ttyFD(), s.termios)
+			}
+			panic(r)
+		}
+		var pagerErr, restoreErr error
+		cerr := Close()
+		if rerr, ok := cerr.(*restoreError); ok {
+			restoreErr = rerr.err
+		} else {
+			pagerErr = cerr
+		}
+		if err != nil || pagerErr != nil || restoreErr != nil {
+			err = &RunError{FuncErr: err, PagerErr: pagerErr, RestoreErr: restoreErr}
+		}
+	}()
+	return fn()
+}
+
+// RunError is the error RunPaged returns, holding each of the errors from the
+// steps of paging fn's output, those that didn't fail left nil.
+type RunError struct {
+	// FuncErr is the error fn returned.
+	FuncErr error
+	// PagerErr is the error from waiting for the pager, as Close
+	// returns, for example an *exec.ExitError.
+	PagerErr error
+	// RestoreErr is the error from putting stdout and stderr back.
+	RestoreErr error
+}
+
+func (e *RunError) errs() []error {
+	var errs []error
+	for _, err := range []error{e.FuncErr, e.PagerErr, e.RestoreErr} {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+func (e *RunError) Error() string {
+	var msgs []string
+	for _, err := range e.errs() {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap returns the first of FuncErr, PagerErr and RestoreErr that isn't
+// nil. errors.Is and errors.As look at all of them, through Is and As.
+func (e *RunError) Unwrap() error {
+	if errs := e.errs(); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// Is reports whether any of the errors is target, as errors.Is does.
+func (e *RunError) Is(target error) bool {
+	for _, err := range e.errs() {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first of the errors that matches target, as errors.As does.
+func (e *RunError) As(target interface{}) bool {
+	for _, err := range e.errs() {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreError marks an error from Close as having come from restoring
+// stdout and stderr, for RunError.
+type restoreError struct {
+	err error
+}
+
+func (e *restoreError) Error() string {
+	return e.err.Error()
+}
+
+func (e *restoreError) Unwrap() error {
+	return e.err
+}
+
+// ReadDuration returns how long the pager last closed by Close or Quit ran
+// for, from being started until it exited. That is roughly the time the user
+// spent reading. It returns 0 if no pager has been closed yet.
+func ReadDuration() time.Duration {
+	readMu.Lock()
+	defer readMu.Unlock()
+	return readDuration
+}
+
+var (
+	readMu       sync.Mutex
+	readDuration time.Duration
+)
+
+// recordDuration saves the run time of a closed pager for ReadDuration.
+func (p *pgr) recordDuration() {
+	if p == nil {
+		return
+	}
+	select {
+	case <-p.exited:
+	default:
+		// close failed before the pager exited.
+		return
+	}
+	readMu.Lock()
+	readDuration = p.exitedAt.Sub(p.startedAt)
+	readMu.Unlock()
+}
+
+// Quit ends the pager started by Open without waiting for the user to quit it,
+// by sending it SIGTERM or the signal given with WithQuitSignal. Stdout and
+// stderr are restored first. Like Close it waits for the pager to exit, but
+// doesn't report the signal ending it as an error.
+//
+// Quit may be called from another goroutine while Close waits for the user,
+// to dismiss the pager on some other event. Close then returns once the
+// pager has gone, without an error for the signal either.
+func Quit() error {
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+	if p == nil {
+		return nil
+	}
+	if s := p; s.closing {
+		// Close is waiting for the user, and finishes closing once the
+		// pager has gone.
+		sessionMu.Unlock()
+		defer sessionMu.Lock()
+		err := s.quit()
+		<-s.closed
+		return err
+	}
+	return closeCurrent(true)
+}
+
+// closeCurrent closes p, quitting it first if quit is set, and clears it.
+// sessionMu must be held. It is released while waiting for the pager, with p
+// marked as closing, so that Quit and Reset can still end it then and other
+// sessions wait for it to finish, in lockSettled.
+func closeCurrent(quit bool) error {
+	s := p
+	s.closing = true
+	s.closed = make(chan struct{})
+	sessionMu.Unlock()
+	var err error
+	if quit {
+		ferr := s.flush()
+		if err = s.quit(); err == nil {
+			err = ferr
+		}
+	}
+	if cerr := s.close(); err == nil {
+		err = cerr
+	}
+	s.recordDuration()
+	sessionMu.Lock()
+	setCurrent(nil)
+	close(s.closed)
 	return err
 }
 
+// lockSettled locks sessionMu once p isn't being closed, so that a session
+// doesn't start while the last one's pager still has the terminal.
+func lockSettled() {
+	sessionMu.Lock()
+	for p != nil && p.closing {
+		closed := p.closed
+		sessionMu.Unlock()
+		<-closed
+		sessionMu.Lock()
+	}
+}
+
+// Reset kills the pager started by Open, if any, without waiting for the user
+// and puts stdout, stderr and the handling of signals back the way they were
+// before Open. It is meant for tests, so that one failing between Open and
+// Close doesn't leave those after it writing to a pager. It does nothing if
+// no pager is open.
+func Reset() {
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+	deferred, deferredRefs = nil, 0
+	if p == nil {
+		return
+	}
+	if s := p; s.closing {
+		// Close is waiting for the pager, and puts everything back
+		// once it's gone.
+		s.kill()
+		sessionMu.Unlock()
+		<-s.closed
+		sessionMu.Lock()
+		return
+	}
+	p.restore()
+	p.restoreSignals()
+	if p.ignoringInterrupt && !p.interruptIgnored {
+		// signal.Reset alone puts back the default handling but leaves
+		// signal.Ignored reporting SIGINT as ignored, which the next Open
+		// would take to be the program's choice. Notifying clears that.
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt)
+		signal.Reset(os.Interrupt)
+	}
+	p.kill()
+	p.close()
+	setCurrent(nil)
+}
+
+// kill kills the processes of the session without waiting for them.
+func (p *pgr) kill() {
+	p.mu.Lock()
+	p.quitting = true
+	p.mu.Unlock()
+	if p.postProcess != nil {
+		p.postProcess.Kill()
+	}
+	if p.filter != nil {
+		p.filter.Kill()
+	}
+	p.proc.Kill()
+	if s := p.stderrPager; s != nil {
+		s.proc.Kill()
+	}
+}
+
+// Done returns a channel that is closed once the pager started by Open has
+// exited, typically because the user quit it, so that a program can select on
+// that alongside other events. Close still has to be called. If no pager is
+// running the channel returned is already closed.
+func Done() <-chan struct{} {
+	s := current()
+	if s == nil {
+		return closedChan
+	}
+	return s.exited
+}
+
+// closedChan is what Done returns without a pager.
+var closedChan = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// SelectedPager returns the path and argv of the pager started by the last
+// successful call to Open. It returns an empty path if no pager is running.
+func SelectedPager() (path string, argv []string) {
+	s := current()
+	if s == nil {
+		return "", nil
+	}
+	return s.path, append([]string(nil), s.argv...)
+}
+
+// IsRedirected reports whether stdout currently goes to a pager started by
+// Open. Code that would otherwise draw progress bars with carriage returns can
+// use it to fall back to plain lines.
+func IsRedirected() bool {
+	s := current()
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.restored
+}
+
+// PipeWriter returns the write end of the pipe feeding the pager started by
+// Open, or nil if no pager is running. Stdout and stderr are duplicates of it,
+// so writing to it directly is equivalent to writing to them. The file is
+// owned by the package and closed by Close; callers must not close it.
+//
+// The read end of the pipe is only held by the pager. If the program kept it
+// open too, writes would block once the pipe filled after the pager exited
+// instead of failing.
+func PipeWriter() *os.File {
+	s := current()
+	if s == nil {
+		return nil
+	}
+	return s.pw
+}
+
 type pgr struct {
-	proc                       *os.Process
+	opts *options
+	path string
+	argv []string
+	// env is the environment the pager was started with.
+	env  []string
+	proc *os.Process
+	pw   *os.File
+	// filter is the process started by WithPreFilter, if any.
+	filter *os.Process
+	// relayed is closed once the relay, if any, has passed on everything
+	// written to pw.
+	relayed chan struct{}
+	// postProcess is the command started by WithPostProcess, if any, and
+	// postProcessed is closed once its output has reached the pager.
+	postProcess   *os.Process
+	postProcessed chan struct{}
+	// replay holds the output for WithReplayOnExit.
+	replay *bytes.Buffer
+	// diagnosed is closed once the pager's stderr has been copied to the
+	// WithPagerDiagnostics writer, if it isn't a file.
+	diagnosed chan struct{}
+	// redirected is set if stdout and stderr were pointed at pw, in which
+	// case storedStdout and storedStderr restore them.
+	redirected                 bool
 	storedStdout, storedStderr int
+	// stderr is os.Stderr while WithSerializedWrites has it replaced by
+	// os.Stdout.
+	stderr *os.File
+	// termios is the terminal mode before the pager started, or nil if it
+	// couldn't be read.
+	termios *unix.Termios
+	// foreground is the terminal's foreground process group before
+	// WithSetpgid handed it to the pager, or 0.
+	foreground int
+	// pty connects the pager to the terminal with WithPTY.
+	pty *ptyProxy
+	// passthrough is set if the pager is cat, which copies output to the
+	// terminal without paging it or reading keys.
+	passthrough bool
+	// interrupts receives SIGINT when it is being forwarded to the pager.
+	interrupts       chan os.Signal
+	interruptIgnored bool
+	// ignoringInterrupt is set if SIGINT is ignored while the pager runs,
+	// which Close leaves in place.
+	ignoringInterrupt bool
+	// scoped is set for the sessions of Page and the others in page.go,
+	// which put SIGINT back as they found it. caught receives the SIGINT
+	// they catch rather than ignore.
+	scoped bool
+	caught chan os.Signal
+	// pipes receives SIGPIPE while WithRestoreOnExit is in effect.
+	pipes chan os.Signal
+	// hangups receives SIGHUP with WithHangupHandling.
+	hangups chan os.Signal
+	// forwarded receives the signals passed on to WithSignalChannel.
+	forwarded chan os.Signal
+
+	// exited is closed once the pager has exited and been reaped, after
+	// which state and waitErr hold the result of waiting for it.
+	exited  chan struct{}
+	state   *os.ProcessState
+	waitErr error
+	// startedAt and exitedAt are when the pager started and exited.
+	startedAt, exitedAt time.Time
+
+	// timer ends the session once WithMaxDuration has passed.
+	timer *time.Timer
+
+	// refs is how many more calls to Close it takes to close the pager,
+	// one for each time Open reused it.
+	refs int
+	// closing is set once Close or Quit is waiting for the pager, and
+	// closed is closed when they are done. Both are guarded by sessionMu.
+	closing bool
+	closed  chan struct{}
+	// stderrPager is the session paging stderr alongside this one with
+	// WithStderrPager, which closing this one closes too.
+	stderrPager *pgr
+
+	mu       sync.Mutex
+	restored bool
+	// quitting is set if the pager was told to quit by Quit or timer,
+	// rather than by the user.
+	quitting bool
+	// hungUp is set if the session ended because the terminal hung up.
+	hungUp bool
+}
+
+// quitRequested reports whether the pager was told to quit by the program.
+func (p *pgr) quitRequested() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.quitting
+}
+
+// quit tells the pager to quit without waiting for the user. Output is
+// restored first so nothing more is written to a pager that's going away.
+func (p *pgr) quit() error {
+	if err := p.restore(); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.quitting = true
+	p.mu.Unlock()
+	// The pager may have already exited, which is fine.
+	if err := p.proc.Signal(p.opts.quitSignal); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return err
+	}
+	if p.stderrPager != nil {
+		return p.stderrPager.quit()
+	}
+	return nil
+}
+
+// hangup ends a session whose terminal has hung up.
+func (p *pgr) hangup() {
+	p.mu.Lock()
+	p.hungUp = true
+	p.mu.Unlock()
+	p.restore()
+	p.mu.Lock()
+	p.quitting = true
+	p.mu.Unlock()
+	// The pager may have already exited, or be on its way.
+	p.proc.Signal(unix.SIGHUP)
+}
+
+// ErrHangup is returned by Close, and Quit, when WithHangupHandling is given
+// and the terminal hung up while the pager ran.
+var ErrHangup = errors.New("pager: terminal hung up")
+
+// ErrSerializedAsync is returned by Open when WithSerializedWrites is given
+// with an option that restores output asynchronously.
+var ErrSerializedAsync = errors.New("pager: WithSerializedWrites can't be used with WithRestoreOnExit, WithMaxDuration or WithHangupHandling")
+
+// expire ends a session that has exceeded WithMaxDuration.
+func (p *pgr) expire() {
+	p.quit()
 }
 
 var p *pgr
 
-func localPager() (name string, args []string) {
-	if pager := os.Getenv("PAGER"); pager != "" {
-		f := strings.Fields(pager)
-		return f[0], f
+// sessionMu serializes opening and closing p, and guards refs. It isn't held
+// while waiting for the user to quit the pager.
+var sessionMu sync.Mutex
+
+// currentMu guards p itself, so that Done and the other accessors can read it
+// without waiting for a session to be opened or closed under sessionMu.
+var currentMu sync.Mutex
+
+// current returns p, for the accessors that don't hold sessionMu.
+func current() *pgr {
+	currentMu.Lock()
+	defer currentMu.Unlock()
+	return p
+}
+
+// setCurrent sets p. sessionMu must be held.
+func setCurrent(s *pgr) {
+	currentMu.Lock()
+	defer currentMu.Unlock()
+	p = s
+}
+
+// isTerminal is replaced by tests, which don't run on a terminal.
+var isTerminal = isatty.IsTerminal
+
+// isSelf is replaced by tests that run the test binary as a fake pager.
+var isSelf = isExecutable
+
+// openTTY is replaced by tests, which have no controlling terminal either.
+var openTTY = func() error {
+	f, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return err
 	}
-	return "", nil
+	return f.Close()
 }
 
-func (p *pgr) close() error {
-	if p == nil {
+// DefaultFallbacks are the pagers tried, in order, when PAGER isn't set or
+// can't be started and WithFallbacks isn't given. "pager" comes first because
+// Debian provides it as an alternative pointing at the system's preferred
+// pager. Open copies it when called, so changes affect later calls only; make
+// them before paging concurrently.
+var DefaultFallbacks = []string{"pager", "less", "more"}
+
+type candidate struct {
+	name string
+	args []string
+}
+
+// localPager returns the pager command from the first variable in the
+// WithEnvPrecedence order, PAGER by default, that is set.
+func localPager(o *options) (name string, args []string, err error) {
+	vars := o.envPrecedence
+	if vars == nil {
+		vars = []string{"PAGER"}
+	}
+	if o.ignoreEnv {
+		vars = nil
+	}
+	for _, v := range vars {
+		args, err := splitArgs(os.Getenv(v))
+		if err != nil {
+			return "", nil, fmt.Errorf("pager: parsing %s: %v", v, err)
+		}
+		// A variable may be set to nothing but whitespace, which we treat
+		// as unset.
+		if len(args) > 0 {
+			o.logf("%s=%q", v, os.Getenv(v))
+			return args[0], args, nil
+		}
+	}
+	return "", nil, nil
+}
+
+// noPagerValue reports whether the pager variable localPager would consult
+// holds one of the WithNoPagerValues values, and which variable it is.
+// WithPager, naming the only pager to try, goes unchecked, but a
+// WithPagerProvider provider doesn't override the user asking for no pager.
+func noPagerValue(o *options) (string, bool) {
+	if o.ignoreEnv || len(o.pager) > 0 {
+		return "", false
+	}
+	vars := o.envPrecedence
+	if vars == nil {
+		vars = []string{"PAGER"}
+	}
+	values := o.noPagerValues
+	if values == nil {
+		values = []string{"cat", ""}
+	}
+	for _, v := range vars {
+		val, set := os.LookupEnv(v)
+		if !set {
+			continue
+		}
+		// As in git, only the exact value counts.
+		for _, nv := range values {
+			if val == nv {
+				return v, true
+			}
+		}
+		// As in localPager, a variable set to nothing but whitespace is
+		// treated as unset.
+		if strings.TrimSpace(val) != "" {
+			return "", false
+		}
+	}
+	return "", false
+}
+
+// candidates returns the pagers to try in order: the one from the
+// WithPagerProvider provider, if it gives one, then the one from the
+// environment, if set, then the ones WithContentTypePagers gives for the
+// WithContentType type, followed by the fallbacks, which are given the
+// arguments in PAGER_DEFAULT_ARGS. A name is only ever returned once.
+func candidates(o *options) ([]candidate, error) {
+	if len(o.pager) > 0 {
+		if o.pager[0] == "" {
+			return nil, errors.New("pager: WithPager gave an empty name")
+		}
+		return []candidate{{o.pager[0], o.pager}}, nil
+	}
+	var cs []candidate
+	seen := make(map[string]bool)
+	if o.provider != nil {
+		if name, args, ok := o.provider(); ok {
+			if name == "" {
+				return nil, errors.New("pager: provider gave an empty name")
+			}
+			cs = append(cs, candidate{name, append([]string{name}, args...)})
+			seen[name] = true
+		}
+	}
+	lp, lpArgs, err := localPager(o)
+	if err != nil {
+		return nil, err
+	}
+	if lp != "" {
+		cs = append(cs, candidate{lp, lpArgs})
+		seen[lp] = true
+	}
+	for _, command := range o.contentPagers() {
+		args, err := splitArgs(command)
+		if err != nil {
+			return nil, fmt.Errorf("pager: parsing pager for %s: %v", o.contentType, err)
+		}
+		if len(args) == 0 {
+			return nil, fmt.Errorf("pager: empty pager for %s", o.contentType)
+		}
+		if seen[args[0]] {
+			continue
+		}
+		cs = append(cs, candidate{args[0], args})
+		seen[args[0]] = true
+	}
+	fallbacks := o.fallbacks
+	if fallbacks == nil {
+		fallbacks = append([]string(nil), DefaultFallbacks...)
+	}
+	var defaultArgs []string
+	if !o.ignoreEnv {
+		defaultArgs, err = splitArgs(os.Getenv("PAGER_DEFAULT_ARGS"))
+		if err != nil {
+			return nil, fmt.Errorf("pager: parsing PAGER_DEFAULT_ARGS: %v", err)
+		}
+	}
+	for i, name := range fallbacks {
+		if name == "" {
+			return nil, fmt.Errorf("pager: fallback %d has an empty name", i)
+		}
+		if seen[name] {
+			continue
+		}
+		cs = append(cs, candidate{name, append([]string{name}, defaultArgs...)})
+		seen[name] = true
+	}
+	return cs, nil
+}
+
+// lookPager finds the pager name like exec.LookPath, and makes sure that it is
+// a regular file, once symlinks are followed, that is executable. It reports
+// whether something by that name exists even if it can't be used, which tells
+// a misconfigured pager from one that simply isn't installed.
+func lookPager(name string) (path string, exists bool, err error) {
+	path, err = exec.LookPath(name)
+	if err != nil {
+		// LookPath finds a path only if it's executable, but may have
+		// rejected one that exists, like a symlink loop.
+		if strings.Contains(name, "/") {
+			if _, lerr := os.Lstat(name); lerr == nil {
+				return "", true, fmt.Errorf("pager: %v", err)
+			}
+		}
+		return "", false, err
+	}
+	// Debian's pager is a symlink to a symlink in /etc/alternatives, so
+	// follow any number of them.
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", true, fmt.Errorf("pager: %v", err)
+	}
+	if !fi.Mode().IsRegular() {
+		return "", true, fmt.Errorf("pager: %s is not a regular file", path)
+	}
+	return path, true, nil
+}
+
+// isExecutable reports whether path is the program's own executable, once
+// symlinks are followed.
+func isExecutable(path string) bool {
+	exe, err := os.Executable()
+	if err != nil {
+		return false
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return false
+	}
+	path, err = filepath.EvalSymlinks(path)
+	return err == nil && path == exe
+}
+
+// restore points stdout and stderr back at where they were before Open and
+// closes the pipe to the pager. Only the first call does anything, so that
+// restore can be called both when the pager is cut short and by close.
+func (p *pgr) restore() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.restored {
 		return nil
 	}
+	p.restored = true
 
-	// Inform pager that we are done.
-	// This can fail if the pipe is closed, but that's fine to ignore.
-	os.Stdout.Sync()
-	if err := unix.Dup2(p.storedStdout, unix.Stdout); err != nil {
+	if p.stderr != nil {
+		os.Stderr = p.stderr
+	}
+	if p.redirected {
+		// Inform pager that we are done.
+		// This can fail if the pipe is closed, but that's fine to ignore.
+		if p.storedStdout >= 0 {
+			os.Stdout.Sync()
+			if err := dup2(p.storedStdout, unix.Stdout); err != nil {
+				return err
+			}
+			if err := closeFD(p.storedStdout); err != nil {
+				return err
+			}
+		}
+		if p.storedStderr >= 0 {
+			os.Stderr.Sync()
+			if err := dup2(p.storedStderr, unix.Stderr); err != nil {
+				return err
+			}
+			if err := closeFD(p.storedStderr); err != nil {
+				return err
+			}
+		}
+	}
+	// This was the last write end of the pipe, so the pager, or the relay,
+	// will see EOF.
+	if err := p.pw.Close(); err != nil {
 		return err
 	}
-	if err := unix.Close(p.storedStdout); err != nil {
+	return nil
+}
+
+// wait reaps the pager, recording how it exited.
+func (p *pgr) wait() {
+	p.state, p.waitErr = p.proc.Wait()
+	p.exitedAt = time.Now()
+	close(p.exited)
+	if p.opts.restoreOnExit {
+		// Send anything written after the pager quit to the terminal.
+		p.restore()
+	}
+}
+
+func (p *pgr) close() error {
+	if p == nil {
+		return nil
+	}
+	if s := p.stderrPager; s != nil {
+		// Wait for the user to quit the stdout pager before ending the
+		// stderr one, which is fed until then.
+		err := p.closeOne()
+		if serr := s.closeOne(); err == nil {
+			err = serr
+		}
 		return err
 	}
-	os.Stderr.Sync()
-	if err := unix.Dup2(p.storedStderr, unix.Stderr); err != nil {
+	return p.closeOne()
+}
+
+// closeOne is close for a single session, leaving out its stderrPager.
+func (p *pgr) closeOne() error {
+	flushErr := p.flush()
+	if err := p.restore(); err != nil {
+		return &restoreError{err}
+	}
+	// The pager may have already exited, which is fine.
+	if sig := p.opts.closeSignal; sig != nil {
+		if err := p.proc.Signal(sig); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			p.restoreSignals()
+			return err
+		}
+	}
+	if p.relayed != nil {
+		<-p.relayed
+	}
+	if p.postProcessed != nil {
+		<-p.postProcessed
+	}
+	filterErr := p.waitFilter()
+	endWait := p.opts.phase("wait")
+	<-p.exited
+	// Keep handling signals until now: the user reads the output while
+	// we wait, and an interrupt or hangup then mustn't kill the program.
+	p.restoreSignals()
+	if p.diagnosed != nil {
+		<-p.diagnosed
+	}
+	state, err := p.state, p.waitErr
+	endWait()
+	// The user quit before the session expired.
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	if err != nil {
 		return err
 	}
-	if err := unix.Close(p.storedStderr); err != nil {
+	if p.pty != nil {
+		p.pty.close()
+	}
+	p.mu.Lock()
+	hungUp := p.hungUp
+	p.mu.Unlock()
+	if hungUp {
+		// There's no terminal left to restore.
+		return ErrHangup
+	}
+	if err := p.restoreForeground(); err != nil {
 		return err
 	}
-	if err := p.proc.Signal(unix.SIGCONT); err != nil {
+	// Pagers switch the terminal out of cooked mode while they run and may
+	// not switch it back if they are killed. Put back the mode we started
+	// with, after any remaining output has drained, so that whatever the
+	// program prints next renders correctly.
+	if err := restoreTermios(p.opts.ttyFD(), p.termios); err != nil {
 		return err
 	}
-	state, err := p.proc.Wait()
+	// Output has been restored, so these reach the terminal.
+	w := os.Stdout
+	if p.opts.streams == StderrOnly {
+		w = os.Stderr
+	}
+	if p.replay != nil {
+		w.Write(p.replay.Bytes())
+	}
+	if footer := p.opts.footer; footer != "" && !p.passthrough {
+		io.WriteString(w, footer)
+	}
+	if !state.Success() && !p.quitRequested() {
+		if h := p.opts.exitCodeHandler; h != nil {
+			if err := h(state.ExitCode()); err != nil {
+				return err
+			}
+		} else {
+			return &exec.ExitError{ProcessState: state}
+		}
+	}
+	if filterErr != nil {
+		return filterErr
+	}
+	return flushErr
+}
+
+// flush calls the WithFlush function, unless output has been restored
+// already, so that what it writes still reaches the pager.
+func (p *pgr) flush() error {
+	p.mu.Lock()
+	restored := p.restored
+	p.mu.Unlock()
+	if p.opts.flush == nil || restored {
+		return nil
+	}
+	return p.opts.flush()
+}
+
+// saveTermios returns the terminal mode of fd, or nil if it can't be read.
+func saveTermios(fd int) *unix.Termios {
+	t, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
 	if err != nil {
+		return nil
+	}
+	return t
+}
+
+// restoreTermios sets the terminal mode of fd to t once pending output has
+// been written. It does nothing if t is nil.
+func restoreTermios(fd int, t *unix.Termios) error {
+	if t == nil {
+		return nil
+	}
+	return unix.IoctlSetTermios(fd, ioctlSetTermios, t)
+}
+
+// dupCloexec duplicates fd like unix.Dup, but marks the duplicate
+// close-on-exec so that it doesn't leak into processes the program starts,
+// the pager included.
+func dupCloexec(fd int) (int, error) {
+	var dup int
+	err := retryEINTR(func() (err error) {
+		dup, err = unix.FcntlInt(uintptr(fd), unix.F_DUPFD_CLOEXEC, 0)
+		return err
+	})
+	return dup, err
+}
+
+// dup2 is unix.Dup2, retried if interrupted by a signal.
+func dup2(oldfd, newfd int) error {
+	return retryEINTR(func() error {
+		return unix.Dup2(oldfd, newfd)
+	})
+}
+
+// closeFD closes fd. Unlike the calls above it must not be retried on EINTR:
+// Linux has already released fd by then, and another goroutine may have been
+// given the same number since.
+func closeFD(fd int) error {
+	if err := unix.Close(fd); err != unix.EINTR {
 		return err
-	} else if !state.Success() {
-		return &exec.ExitError{ProcessState: state}
 	}
 	return nil
 }
 
-func open() (*pgr, error) {
+// retryEINTR calls f until it returns an error other than EINTR. The runtime
+// installs its signal handlers with SA_RESTART, so this only matters for
+// signals handled by code outside of Go.
+func retryEINTR(f func() error) error {
+	for {
+		if err := f(); err != unix.EINTR {
+			return err
+		}
+	}
+}
+
+// redirect points stdout, stderr or both, as streams says, at fd,
+// returning close-on-exec duplicates of the originals that restore them, or
+// -1 for stdout if it was left alone. The duplicates are separate
+// descriptors, so closing fd afterwards doesn't affect stdout and stderr. On
+// error nothing is changed.
+//
+// Descriptors made by dup2 share the open file description of the one they
+// copy, so stdout and stderr end up sharing a single description, with its
+// offset and flags, just as if stderr were made a dup of stdout.
+func redirect(fd int, streams Streams) (storedStdout, storedStderr int, err error) {
+	storedStdout, storedStderr = -1, -1
+	if streams != StderrOnly {
+		if storedStdout, err = redirectFD(fd, unix.Stdout); err != nil {
+			return -1, -1, err
+		}
+	}
+	if streams == StdoutOnly {
+		return storedStdout, -1, nil
+	}
+	if storedStderr, err = redirectFD(fd, unix.Stderr); err != nil {
+		if storedStdout >= 0 {
+			dup2(storedStdout, unix.Stdout)
+			closeFD(storedStdout)
+		}
+		return -1, -1, err
+	}
+	return storedStdout, storedStderr, nil
+}
+
+// redirectFD points target at fd, returning a close-on-exec duplicate of the
+// original target.
+func redirectFD(fd, target int) (stored int, err error) {
+	stored, err = dupCloexec(target)
+	if err != nil {
+		return -1, err
+	}
+	if err := dup2(fd, target); err != nil {
+		closeFD(stored)
+		return -1, err
+	}
+	return stored, nil
+}
+
+// shouldPage reports whether the program is running somewhere a pager makes
+// sense.
+func shouldPage(o *options) bool {
+	if reason := skipReason(o); reason != "" {
+		o.logf("not paging: %s", reason)
+		return false
+	}
+	return true
+}
+
+// skipReason returns why the program isn't running somewhere a pager makes
+// sense, or "" if it is.
+func skipReason(o *options) string {
+	if o.disableEnv != "" && truthy(os.Getenv(o.disableEnv)) {
+		return o.disableEnv + " is set"
+	}
+	if v, ok := noPagerValue(o); ok {
+		return fmt.Sprintf("%s=%q", v, os.Getenv(v))
+	}
+	if o.force {
+		return ""
+	}
 	// no paging if we're not on a tty
-	if !isatty.IsTerminal(os.Stdout.Fd()) || !isatty.IsTerminal(os.Stderr.Fd()) {
-		return nil, nil
+	switch o.streams {
+	case StderrOnly:
+		if !isTerminal(os.Stderr.Fd()) {
+			return "stderr isn't a terminal"
+		}
+	case StdoutOnly:
+		if !isTerminal(os.Stdout.Fd()) {
+			return "stdout isn't a terminal"
+		}
+	default:
+		if !isTerminal(os.Stdout.Fd()) || !isTerminal(os.Stderr.Fd()) {
+			return "stdout or stderr isn't a terminal"
+		}
+	}
+	// no paging on dumb terminals, unless asked to
+	if term := os.Getenv("TERM"); IsDumbTerminal(term) && !o.pageDumbTerminals {
+		return fmt.Sprintf("TERM=%q is a dumb terminal", term)
+	}
+	// Pagers read keystrokes from /dev/tty, which a daemon or cron job
+	// may not have even when it inherited fds leading to a terminal. A
+	// pager there couldn't be quit. WithPTY gives the pager a terminal of
+	// its own.
+	if !o.pty {
+		if err := openTTY(); err != nil {
+			if !o.quiet {
+				log.Printf("Not paging since the terminal can't be opened for input: %v", err)
+			}
+			return err.Error()
+		}
+	}
+	return ""
+}
+
+// truthy reports whether v, the value of an environment variable, means yes:
+// 1, true or yes in any case.
+func truthy(v string) bool {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "1", "true", "yes":
+		return true
+	}
+	return false
+}
+
+// IsDumbTerminal reports whether Open treats a terminal with the given TERM
+// as dumb, and so doesn't page on it without WithPageDumbTerminals. That is
+// the case if term is empty or "dumb".
+func IsDumbTerminal(term string) bool {
+	return term == "" || term == "dumb"
+}
+
+// PagerSupportsColor reports whether the pager name, a name or a path, is
+// likely to show ANSI colors rather than the raw escape sequences, as less
+// with -R, most and bat do. It's a guess from the name: more and pg are taken
+// not to, and any other pager to. A path is resolved first, so that Debian's
+// pager alternative counts as the pager it leads to. Programs can use it to
+// decide whether to color their own output.
+func PagerSupportsColor(name string) bool {
+	if filepath.IsAbs(name) {
+		if resolved, err := filepath.EvalSymlinks(name); err == nil {
+			name = resolved
+		}
+	}
+	switch filepath.Base(name) {
+	case "more", "pg":
+		return false
+	}
+	return true
+}
+
+// IsInteractiveTerminal reports whether fd is a terminal, as Open requires
+// stdout and stderr to be for it to page.
+func IsInteractiveTerminal(fd uintptr) bool {
+	return isTerminal(fd)
+}
+
+// prepared is a candidate pager ready to be started.
+type prepared struct {
+	path string
+	argv []string
+	env  []string
+}
+
+// prepare finds the candidate c and checks it can be used, returning what to
+// start it with. It returns false to move on to the next candidate, or an
+// error to stop trying them at all. tried holds the paths already tried, and
+// env the environment shared by candidates, built on first use.
+func prepare(o *options, c candidate, tried map[string]bool, env *[]string) (prepared, bool, error) {
+	o.logf("trying %s", c.name)
+	lp, exists, err := lookPager(c.name)
+	if err != nil {
+		o.logf("%s: %v", c.name, err)
+		if o.strict && exists {
+			return prepared{}, false, err
+		}
+		return prepared{}, false, nil
+	}
+	// PAGER may name a fallback by its full path.
+	if tried[lp] {
+		o.logf("%s: already tried %s", c.name, lp)
+		return prepared{}, false, nil
+	}
+	tried[lp] = true
+	if isSelf(lp) {
+		// The program would end up paging into itself, which then
+		// waits on a pager of its own.
+		if !o.quiet {
+			log.Printf("Not using %s as a pager since it is this program", lp)
+		}
+		return prepared{}, false, nil
+	}
+	if !o.allowed(lp) {
+		o.logf("%s: not in WithPagerAllowlist", lp)
+		if o.strict {
+			return prepared{}, false, fmt.Errorf("pager: %s isn't an allowed pager", lp)
+		}
+		return prepared{}, false, nil
+	}
+	// Only build the environment once there's a pager to give it to.
+	if *env == nil {
+		*env = o.env()
 	}
-	// no paging on dumb terminals
-	if term := os.Getenv("TERM"); term == "" || term == "dumb" {
+	pc := prepared{lp, o.argv(lp, c), *env}
+	if o.preSpawn != nil {
+		// Let the hook change copies, so later candidates start from the
+		// same environment.
+		argv := append([]string(nil), pc.argv...)
+		env := append([]string(nil), pc.env...)
+		pc.path, pc.argv, pc.env, err = o.preSpawn(lp, argv, env)
+		if err != nil {
+			o.logf("%s: vetoed by WithPreSpawn: %v", pc.path, err)
+			return prepared{}, false, err
+		}
+	}
+	return pc, true, nil
+}
+
+// start finds and starts a pager reading from a new pipe, or returns nil if
+// paging should be skipped. The returned session isn't yet redirecting
+// stdout and stderr or handling signals.
+func start(o *options) (*pgr, error) {
+	if !shouldPage(o) {
 		return nil, nil
 	}
 
-	// add reasonable defaults for less.
-	env := append(os.Environ(),
-		"LESS=FRSM",
-		"LESSCHARSET=utf-8",
-	)
+	cs, err := candidates(o)
+	if err != nil {
+		return nil, err
+	}
+
 	pr, pw, err := os.Pipe()
 	if err != nil {
 		return nil, err
 	}
+	// The pager gets its own copy of pr when it starts. Close ours so the
+	// pager holds the only read end and writes fail once it exits.
 	defer pr.Close()
-	defer pw.Close()
+	o.resizePipe(pw)
+	// The pager reads the program's output from its stdin, the pipe, and
+	// writes to the terminal. Since its stdin isn't the terminal it has to
+	// find keystrokes elsewhere: less opens /dev/tty and more reads them from
+	// stderr, which we leave as the terminal for that reason. A pager that
+	// does neither can't be navigated.
 	procAttr := &os.ProcAttr{
-		Env:   env,
 		Files: []*os.File{pr, os.Stdout, os.Stderr},
 	}
+	if o.streams == StderrOnly {
+		// stdout isn't the terminal, so have the pager draw to stderr.
+		procAttr.Files[1] = os.Stderr
+	}
+	// diag is the read end of the pipe for the pager's stderr, if
+	// WithPagerDiagnostics gave a writer that isn't a file.
+	var diag *os.File
+	if f, ok := o.pagerStderr.(*os.File); ok {
+		procAttr.Files[2] = f
+	} else if o.pagerStderr != nil {
+		dr, dw, err := os.Pipe()
+		if err != nil {
+			pw.Close()
+			return nil, err
+		}
+		// As with pr, the pager has its own copy of dw.
+		defer dw.Close()
+		procAttr.Files[2], diag = dw, dr
+	}
+	// cat is started with these whatever other options say.
+	plainFiles, plainSys := procAttr.Files, (*syscall.SysProcAttr)(nil)
+	if o.credential != nil {
+		plainSys = &syscall.SysProcAttr{Credential: o.credential}
+	}
+	tty := o.ttyFD()
+	termios := saveTermios(tty)
+	var (
+		pty   *ptyProxy
+		slave *os.File
+	)
+	if o.pty {
+		pty, slave, err = newPTY(tty, termios)
+		if err != nil {
+			pw.Close()
+			return nil, fmt.Errorf("pager: allocating a pty: %v", err)
+		}
+		// Being the session leader of the pty, the pager gets the signals
+		// for the keys typed into it.
+		procAttr.Files = []*os.File{pr, slave, slave}
+		procAttr.Sys = &syscall.SysProcAttr{
+			Setsid:  true,
+			Setctty: true,
+			Ctty:    1,
+		}
+	}
+	foreground := 0
+	if o.setpgid && !o.pty {
+		foreground, err = unix.IoctlGetInt(tty, unix.TIOCGPGRP)
+		if err != nil {
+			pw.Close()
+			return nil, err
+		}
+		// The child takes the terminal before it execs the pager, and
+		// before it sets up its fds, so Ctty is one of ours.
+		procAttr.Sys = &syscall.SysProcAttr{
+			Foreground: true,
+			Ctty:       tty,
+		}
+	}
 
-	var proc *os.Process
-	lp, lpArgs := localPager()
-	for _, p := range []struct {
-		name string
-		args []string
-	}{
-		{lp, lpArgs},
-		// debian provides an alternatives file named "pager"
-		{"pager", []string{"pager"}},
-		{"less", []string{"less"}},
-		{"more", []string{"more"}},
-	} {
-		// when PAGER isn't set.
-		if p.name == "" {
-			continue
+	if o.credential != nil {
+		if procAttr.Sys == nil {
+			procAttr.Sys = &syscall.SysProcAttr{}
 		}
-		path, err := exec.LookPath(p.name)
+		procAttr.Sys.Credential = o.credential
+	}
+
+	var (
+		proc      *os.Process
+		path      string
+		args      []string
+		env       []string
+		startedAt time.Time
+		// passthrough is set if the pager is cat.
+		passthrough bool
+	)
+	tried := make(map[string]bool)
+	endSelect := o.phase("select")
+	var abortErr error
+	for _, c := range cs {
+		pc, ok, err := prepare(o, c, tried, &procAttr.Env)
 		if err != nil {
+			abortErr = err
+			break
+		}
+		if !ok {
 			continue
 		}
-		p, err := os.StartProcess(path, p.args, procAttr)
+		lp, argv, attr := pc.path, pc.argv, *procAttr
+		attr.Env = pc.env
+		cat := filepath.Base(lp) == "cat"
+		if cat {
+			attr.Files, attr.Sys = plainFiles, plainSys
+		}
+		endSpawn := o.phase("spawn")
+		p, err := os.StartProcess(lp, argv, &attr)
 		if err != nil {
+			o.logf("starting %s: %v", lp, err)
+			if o.strict {
+				abortErr = fmt.Errorf("pager: starting %s: %v", lp, err)
+				break
+			}
 			continue
 		}
-		proc = p
+		endSpawn()
+		proc, path, args, env, startedAt = p, lp, argv, attr.Env, time.Now()
+		passthrough = cat
+		o.logf("started %s %q, pid %d", lp, argv, p.Pid)
 		break
 	}
+	endSelect()
+	if passthrough && pty != nil {
+		pty.release()
+		pty = nil
+	}
+	if slave != nil {
+		// As with pr, the pager has its own copy. Closing ours lets the
+		// proxy see when the pager is done with the pty.
+		slave.Close()
+	}
+	if passthrough {
+		foreground = 0
+	}
 	// If we can't find a suitable pager just log an error
 	if proc == nil {
-		log.Print("Failed to find a suitable pager, continuing without one")
+		pw.Close()
+		if diag != nil {
+			diag.Close()
+		}
+		if pty != nil {
+			pty.release()
+		}
+		if abortErr != nil {
+			return nil, abortErr
+		}
+		if !o.quiet {
+			log.Print("Failed to find a suitable pager, continuing without one")
+		}
 		return nil, nil
 	}
-	// save stdout and stderr so that we can restore them when we close the pager
-	storedStdout, err := unix.Dup(unix.Stdout)
-	if err != nil {
+
+	p := &pgr{
+		opts:        o,
+		path:        path,
+		argv:        args,
+		env:         env,
+		proc:        proc,
+		pw:          pw,
+		termios:     termios,
+		exited:      make(chan struct{}),
+		startedAt:   startedAt,
+		foreground:  foreground,
+		pty:         pty,
+		passthrough: passthrough,
+	}
+	if pty != nil {
+		pty.start(!o.noSignalHandling)
+	}
+	if diag != nil {
+		p.diagnosed = make(chan struct{})
+		go func() {
+			io.Copy(o.pagerStderr, diag)
+			diag.Close()
+			close(p.diagnosed)
+		}()
+	}
+	if o.preFilter != nil {
+		if err := p.startFilter(o.preFilter); err != nil {
+			p.abort()
+			return nil, err
+		}
+	}
+	if o.postProcess != nil {
+		if err := p.startPostProcess(o.postProcess); err != nil {
+			p.abort()
+			return nil, err
+		}
+	}
+	if o.needsRelay(path) {
+		rr, rw, err := os.Pipe()
+		if err != nil {
+			p.abort()
+			return nil, err
+		}
+		o.resizePipe(rw)
+		// The relay owns p.pw from here on, closing it when rw is closed.
+		p.relayed = make(chan struct{})
+		var replay io.Writer
+		if o.replayOnExit && !passthrough {
+			p.replay = new(bytes.Buffer)
+			replay = p.replay
+		}
+		go relay(p.pw, rr, o, o.stripColor(path), replay, p.relayed)
+		p.pw = rw
+	}
+	return p, nil
+}
+
+// abort ends a session that failed to start, without waiting for the user.
+func (p *pgr) abort() {
+	p.pw.Close()
+	if p.postProcess != nil {
+		p.postProcess.Kill()
+	}
+	if p.filter != nil {
+		p.filter.Kill()
+		p.filter.Wait()
+	}
+	p.proc.Kill()
+	p.proc.Wait()
+	if p.postProcessed != nil {
+		// With the pager gone, falling back to the unprocessed output
+		// can't block.
+		<-p.postProcessed
+	}
+	if p.pty != nil {
+		p.pty.close()
+	}
+}
+
+// begin finishes setting up a started session.
+func (p *pgr) begin() {
+	go p.wait()
+	p.handleSignals()
+	if p.opts.maxDuration > 0 {
+		p.timer = time.AfterFunc(p.opts.maxDuration, p.expire)
+	}
+}
+
+func open(o *options) (*pgr, error) {
+	if o.stdoutPager != nil && o.stderrPager != nil {
+		return openSplit(o)
+	}
+	o.useStreamPager()
+	if o.serializedWrites && o.streams == Both && (o.restoreOnExit || o.maxDuration > 0 || o.hangupHandling) {
+		return nil, ErrSerializedAsync
+	}
+	p, err := start(o)
+	if p == nil || err != nil {
 		return nil, err
 	}
-	storedStderr, err := unix.Dup(unix.Stderr)
-	if err != nil {
+	if err := p.redirectOutput(); err != nil {
+		// Don't leave the pager waiting on a terminal we aren't giving it.
+		p.abort()
 		return nil, err
 	}
-	if err := unix.Dup2(int(pw.Fd()), unix.Stdout); err != nil {
+	p.begin()
+	return p, nil
+}
+
+// openSplit starts the pagers given by WithStdoutPager and WithStderrPager,
+// returning the stdout one, which closes the other.
+func openSplit(o *options) (*pgr, error) {
+	outOpts, errOpts := *o, *o
+	outOpts.pager, outOpts.streams = o.stdoutPager, StdoutOnly
+	errOpts.pager, errOpts.streams = o.stderrPager, StderrOnly
+	// Only the stdout pager is meant to be interactive, so it alone takes
+	// the terminal and handles signals.
+	errOpts.setpgid, errOpts.pty, errOpts.noSignalHandling = false, false, true
+	// Start both before redirecting either, so that each is given the
+	// terminal, not the other's pipe, for the fds it doesn't read.
+	ep, err := start(&errOpts)
+	if err != nil {
 		return nil, err
 	}
-	if err := unix.Dup2(int(pw.Fd()), unix.Stderr); err != nil {
+	op, err := start(&outOpts)
+	if err != nil {
+		if ep != nil {
+			ep.abort()
+		}
 		return nil, err
 	}
+	// Only one of them may page, as when just one stream is a terminal.
+	switch {
+	case op == nil:
+		op = ep
+	case ep != nil:
+		op.stderrPager = ep
+	}
+	if op == nil {
+		return nil, nil
+	}
+	for s := op; s != nil; s = s.stderrPager {
+		if err := s.redirectOutput(); err != nil {
+			for s := op; s != nil; s = s.stderrPager {
+				s.restore()
+				s.abort()
+			}
+			return nil, err
+		}
+	}
+	for s := op; s != nil; s = s.stderrPager {
+		s.begin()
+	}
+	return op, nil
+}
 
-	// Ignore SIGINT, letting our pager handle it if it finds it
-	// appropriate. This feels like hacky, but it works, so eh?
-	signal.Ignore(os.Interrupt)
-	return &pgr{proc, storedStdout, storedStderr}, nil
+// redirectOutput points the streams the session pages at its pipe.
+func (p *pgr) redirectOutput() error {
+	// The pager is already running, and the saved fds are close-on-exec
+	// besides, so the only fds it has are the ones in procAttr.Files.
+	var err error
+	p.storedStdout, p.storedStderr, err = redirect(int(p.pw.Fd()), p.opts.streams)
+	if err != nil {
+		return err
+	}
+	p.redirected = true
+	if p.opts.serializedWrites && p.opts.streams == Both {
+		// Both go to the pipe now, and writes through one *os.File hold
+		// its lock until they're done.
+		p.stderr = os.Stderr
+		os.Stderr = os.Stdout
+	}
+	return nil
 }
@@ -0,0 +1,420 @@
+// Copyright 2019 Mike Gerow
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pager
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// pagerFDs returns where the fds of a pager started with the script from
+// fdScript led.
+func pagerFDs(t *testing.T, out string) []string {
+	t.Helper()
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(b)), "\n")
+}
+
+// fdScript returns a pager script recording where fds 0 to 2 lead to out.
+func fdScript(out string) string {
+	return "fds=$(for fd in 0 1 2; do readlink /proc/$$/fd/$fd; done)\n" +
+		"echo \"$fds\" >" + out + "\ncat >/dev/null"
+}
+
+func TestPagerFDs(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "fds")
+	testPager(t, fdScript(out))
+	stdout, err := os.Readlink("/proc/self/fd/1")
+	if err != nil {
+		t.Skip(err)
+	}
+	stderr, err := os.Readlink("/proc/self/fd/2")
+	if err != nil {
+		t.Skip(err)
+	}
+	if err := Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	fds := pagerFDs(t, out)
+	if len(fds) != 3 {
+		t.Fatalf("pager recorded fds %q, want 3", fds)
+	}
+	if !strings.HasPrefix(fds[0], "pipe:") {
+		t.Errorf("pager stdin = %q, want the content pipe", fds[0])
+	}
+	// Pagers write to, and more reads keystrokes from, the real terminal.
+	if fds[1] != stdout {
+		t.Errorf("pager stdout = %q, want the program's stdout %q", fds[1], stdout)
+	}
+	if fds[2] != stderr {
+		t.Errorf("pager stderr = %q, want the program's stderr %q", fds[2], stderr)
+	}
+}
+
+func TestPagerInheritsOnlyStdio(t *testing.T) {
+	testPager(t, "")
+	cat, err := exec.LookPath("cat")
+	if err != nil {
+		t.Skip(err)
+	}
+	// cat blocks reading the pipe until Close without writing anything.
+	setenv(t, "PAGER", cat)
+	// Capturing adds a second pipe, which mustn't leak either.
+	if err := Open(WithCapture(io.Discard)); err != nil {
+		t.Fatal(err)
+	}
+	// cat may briefly have files of its own open while it starts, so
+	// look again before calling an extra fd a leak.
+	want := []string{"0", "1", "2"}
+	var names []string
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		names, err = fdNames(p.proc.Pid)
+		if err != nil || reflect.DeepEqual(names, want) || time.Now().After(deadline) {
+			break
+		}
+	}
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("pager has fds %q, want %q", names, want)
+	}
+}
+
+// fdNames returns the fds the process pid has open.
+func fdNames(pid int) ([]string, error) {
+	fds, err := os.ReadDir(fmt.Sprintf("/proc/%d/fd", pid))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fd := range fds {
+		names = append(names, fd.Name())
+	}
+	return names, nil
+}
+
+func TestRunPagedPanicRestoresFDs(t *testing.T) {
+	testPager(t, "cat >/dev/null")
+	before := make([]string, 3)
+	for fd := range before {
+		link, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", fd))
+		if err != nil {
+			t.Skip(err)
+		}
+		before[fd] = link
+	}
+	func() {
+		defer func() { recover() }()
+		RunPaged(func() error { panic("oops") })
+	}()
+	for fd, want := range before {
+		if got, _ := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", fd)); got != want {
+			t.Errorf("fd %d leads to %q after the panic, want %q", fd, got, want)
+		}
+	}
+}
+
+// onTerminal reports whether the test is running on a terminal of its own.
+// If it isn't, onTerminal runs it again in a child of the test binary whose
+// controlling terminal is a new pty, on its stdin and stderr and, unless
+// stdoutFile is set, its stdout, which then goes to a file. The child's
+// failures are reported as the test's.
+func onTerminal(t *testing.T, stdoutFile bool) bool {
+	t.Helper()
+	return typing(t, stdoutFile, "")
+}
+
+// typing is onTerminal, and also types keys at the terminal every 100ms
+// until the child is done with it.
+func typing(t *testing.T, stdoutFile bool, keys string) bool {
+	t.Helper()
+	if os.Getenv("PAGER_TEST_TERMINAL") != "" {
+		return true
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		t.Skip(err)
+	}
+	master, slave, err := openpty()
+	if err != nil {
+		t.Skip(err)
+	}
+	defer master.Close()
+	cmd := exec.Command(exe, "-test.run=^"+t.Name()+"$", "-test.v")
+	cmd.Env = append(os.Environ(), "PAGER_TEST_TERMINAL=1")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+	var out *os.File
+	if stdoutFile {
+		if out, err = os.Create(filepath.Join(t.TempDir(), "stdout")); err != nil {
+			t.Fatal(err)
+		}
+		defer out.Close()
+		cmd.Stdout = out
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+	if err := cmd.Start(); err != nil {
+		slave.Close()
+		t.Skip(err)
+	}
+	slave.Close()
+	var drawn bytes.Buffer
+	copied := make(chan struct{})
+	go func() {
+		// Reading fails once the child and its pagers are done with the
+		// pty.
+		io.Copy(&drawn, master)
+		close(copied)
+	}()
+	if keys != "" {
+		go func() {
+			tick := time.NewTicker(100 * time.Millisecond)
+			defer tick.Stop()
+			for {
+				select {
+				case <-copied:
+					return
+				case <-tick.C:
+					master.Write([]byte(keys))
+				}
+			}
+		}()
+	}
+	err = cmd.Wait()
+	<-copied
+	if err != nil {
+		if out != nil {
+			b, _ := os.ReadFile(out.Name())
+			drawn.Write(b)
+		}
+		t.Errorf("on a terminal: %v\n%s", err, drawn.String())
+	}
+	return false
+}
+
+// foreground returns the process group and the terminal's foreground group
+// recorded by a pager started with the script from pgrpScript.
+func foreground(t *testing.T, out string) (pgrp, tpgid string) {
+	t.Helper()
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) != 2 {
+		t.Fatalf("pager recorded %q, want its group and the foreground group", b)
+	}
+	return fields[0], fields[1]
+}
+
+// pgrpScript returns a pager script recording its process group and the
+// terminal's foreground group to out, fields 5 and 8 of its stat.
+func pgrpScript(out string) string {
+	return "cut -d' ' -f5,8 /proc/$$/stat >" + out + "\ncat >/dev/null"
+}
+
+func TestSetpgid(t *testing.T) {
+	if !onTerminal(t, false) {
+		return
+	}
+	out := filepath.Join(t.TempDir(), "pgrp")
+	testPager(t, pgrpScript(out))
+	if err := Open(WithSetpgid(true)); err != nil {
+		t.Fatal(err)
+	}
+	ignoring := p.ignoringInterrupt
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	if ignoring {
+		t.Error("SIGINT ignored while the pager held the foreground")
+	}
+	pgrp, tpgid := foreground(t, out)
+	if pgrp != tpgid || pgrp == strconv.Itoa(unix.Getpgrp()) {
+		t.Errorf("pager in group %s with %s in the foreground, want it in a foreground group of its own", pgrp, tpgid)
+	}
+	if fg, err := unix.IoctlGetInt(unix.Stdout, unix.TIOCGPGRP); err != nil || fg != unix.Getpgrp() {
+		t.Errorf("foreground group after Close = %d, %v, want ours, %d", fg, err, unix.Getpgrp())
+	}
+}
+
+func TestSetpgidStderrOnly(t *testing.T) {
+	if !onTerminal(t, true) {
+		return
+	}
+	out := filepath.Join(t.TempDir(), "pgrp")
+	testPager(t, pgrpScript(out))
+	// stdout is a file, so the terminal the pager takes is stderr.
+	if err := Open(WithSetpgid(true), WithStreams(StderrOnly)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	pgrp, tpgid := foreground(t, out)
+	if pgrp != tpgid || pgrp == strconv.Itoa(unix.Getpgrp()) {
+		t.Errorf("pager in group %s with %s in the foreground, want it in a foreground group of its own", pgrp, tpgid)
+	}
+	if fg, err := unix.IoctlGetInt(unix.Stderr, unix.TIOCGPGRP); err != nil || fg != unix.Getpgrp() {
+		t.Errorf("foreground group after Close = %d, %v, want ours, %d", fg, err, unix.Getpgrp())
+	}
+}
+
+func TestPTY(t *testing.T) {
+	if !onTerminal(t, false) {
+		return
+	}
+	out := filepath.Join(t.TempDir(), "fds")
+	testPager(t, fdScript(out))
+	terminal, err := os.Readlink("/proc/self/fd/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := unix.IoctlGetTermios(unix.Stdout, ioctlGetTermios)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Open(WithPTY(true)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	fds := pagerFDs(t, out)
+	if len(fds) != 3 {
+		t.Fatalf("pager recorded fds %q, want 3", fds)
+	}
+	if !strings.HasPrefix(fds[1], "/dev/pts/") || fds[1] == terminal || fds[2] != fds[1] {
+		t.Errorf("pager stdout and stderr = %q, %q, want a pty other than the terminal %q", fds[1], fds[2], terminal)
+	}
+	after, err := unix.IoctlGetTermios(unix.Stdout, ioctlGetTermios)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(after, before) {
+		t.Errorf("terminal mode after Close = %+v, want %+v", after, before)
+	}
+}
+
+func TestMoreReadsKeystrokes(t *testing.T) {
+	if !typing(t, false, "q") {
+		return
+	}
+	testPager(t, "")
+	more, err := exec.LookPath("more")
+	if err != nil {
+		t.Skip(err)
+	}
+	setenv(t, "PAGER", more)
+	if err := Open(); err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan error, 1)
+	go func() {
+		// More than a screen, so more waits for a key after the first.
+		for i := 0; i < 1000; i++ {
+			fmt.Println("line", i)
+		}
+		closed <- Close()
+	}()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("more never read the q typed at the terminal")
+	}
+}
+
+func TestPageCommandInterrupt(t *testing.T) {
+	testPager(t, "cat >/dev/null")
+	defaultInterrupt()
+	out := filepath.Join(t.TempDir(), "status")
+	cmd := exec.Command("sh", "-c", "grep SigIgn /proc/self/status >"+out)
+	if _, err := PageCommand(cmd); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) != 2 {
+		t.Fatalf("command recorded %q, want its ignored signals", b)
+	}
+	ignored, err := strconv.ParseUint(fields[1], 16, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ignored&(1<<(unix.SIGINT-1)) != 0 {
+		t.Errorf("command started with SIGINT ignored, SigIgn %s", fields[1])
+	}
+}
+
+func TestNoSignalHandlingTerminal(t *testing.T) {
+	if !onTerminal(t, false) {
+		return
+	}
+	testPager(t, "cat >/dev/null")
+	if err := Open(WithPTY(true), WithNoSignalHandling(true)); err != nil {
+		t.Fatal(err)
+	}
+	resizes := p.pty.resizes
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	if resizes != nil {
+		t.Error("SIGWINCH notified for the pty")
+	}
+	// Giving the terminal back is left to the program's handling of
+	// SIGTTOU, which it ignores.
+	signal.Ignore(unix.SIGTTOU)
+	defer signal.Reset(unix.SIGTTOU)
+	if err := Open(WithSetpgid(true), WithNoSignalHandling(true)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	if fg, err := unix.IoctlGetInt(unix.Stdout, unix.TIOCGPGRP); err != nil || fg != unix.Getpgrp() {
+		t.Errorf("foreground group after Close = %d, %v, want ours, %d", fg, err, unix.Getpgrp())
+	}
+	if !signal.Ignored(unix.SIGTTOU) {
+		t.Error("SIGTTOU no longer ignored after Close")
+	}
+}
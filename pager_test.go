@@ -0,0 +1,1917 @@
+// Copyright 2019 Mike Gerow
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pager
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// setenv sets an environment variable for the duration of a test.
+func setenv(t testing.TB, key, value string) {
+	t.Helper()
+	old, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+// testPager makes Open act as if it were running on a terminal and use a
+// pager that runs the given shell script.
+func testPager(t testing.TB, script string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "testpager")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	setenv(t, "PAGER", path)
+	setenv(t, "TERM", "xterm")
+	old := isTerminal
+	isTerminal = func(uintptr) bool { return true }
+	oldTTY := openTTY
+	openTTY = func() error { return nil }
+	t.Cleanup(func() { isTerminal, openTTY = old, oldTTY })
+}
+
+// trapScript returns a pager script that records sig, as trap names it, to
+// out and exits if it gets that signal, and otherwise copies its input to
+// /dev/null and sleeps for a while. It creates ready once the trap is set.
+func trapScript(sig, out, ready string) string {
+	return "trap 'echo " + sig + " >" + out + "; exit 0' " + sig + "\n" +
+		"touch " + ready + "\ncat >/dev/null\nsleep 0.5 & wait"
+}
+
+// waitForFile waits for a pager to create path.
+func waitForFile(t *testing.T, path string) {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(path); err == nil {
+			return
+		}
+	}
+	t.Fatalf("pager didn't create %s", path)
+}
+
+// countFDs returns the number of file descriptors the process has open.
+func countFDs(t *testing.T) int {
+	t.Helper()
+	fds, err := os.ReadDir("/dev/fd")
+	if err != nil {
+		t.Skipf("can't list open fds: %v", err)
+	}
+	return len(fds)
+}
+
+// signalDuringClose sends sig to the test process once Close has had time
+// to start waiting for the pager.
+func signalDuringClose(sig unix.Signal) {
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		unix.Kill(os.Getpid(), sig)
+	}()
+}
+
+func candidateNames(cs []candidate) []string {
+	var names []string
+	for _, c := range cs {
+		names = append(names, c.name)
+	}
+	return names
+}
+
+func TestCandidatesDedupe(t *testing.T) {
+	setenv(t, "PAGER", "less -R")
+	cs, err := candidates(newOptions([]Option{
+		WithFallbacks("most", "less", "most", "more"),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"less", "most", "more"}
+	if got := candidateNames(cs); !reflect.DeepEqual(got, want) {
+		t.Errorf("candidates = %q, want %q", got, want)
+	}
+	if want := []string{"less", "-R"}; !reflect.DeepEqual(cs[0].args, want) {
+		t.Errorf("PAGER args = %q, want %q", cs[0].args, want)
+	}
+}
+
+func TestCandidatesEmptyFallback(t *testing.T) {
+	setenv(t, "PAGER", "")
+	if _, err := candidates(newOptions([]Option{WithFallbacks("less", "")})); err == nil {
+		t.Error("candidates succeeded with an empty fallback name")
+	}
+}
+
+func TestArgvSymlinkedLess(t *testing.T) {
+	dir := t.TempDir()
+	less, pager := filepath.Join(dir, "less"), filepath.Join(dir, "pager")
+	if err := os.WriteFile(less, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// As Debian's pager leads to less through the alternatives.
+	if err := os.Symlink(less, pager); err != nil {
+		t.Skip(err)
+	}
+	o := newOptions([]Option{WithPrompt("hi"), WithLineNumbers(true), WithNoInitialClear(true)})
+	got := o.argv(pager, candidate{"pager", []string{"pager"}})
+	want := []string{"pager", "-X", "-N", "-Pshi", "-Pmhi", "-PMhi"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("argv = %q, want %q", got, want)
+	}
+}
+
+func TestArgvPrompt(t *testing.T) {
+	o := newOptions([]Option{WithPrompt("git log 50%?")})
+	c := candidate{"less", []string{"less"}}
+	want := []string{"less", `-Psgit log 50\%\?`, `-Pmgit log 50\%\?`, `-PMgit log 50\%\?`}
+	if got := o.argv("/usr/bin/less", c); !reflect.DeepEqual(got, want) {
+		t.Errorf("argv = %q, want %q", got, want)
+	}
+	if got := o.argv("/bin/more", candidate{"more", []string{"more"}}); !reflect.DeepEqual(got, []string{"more"}) {
+		t.Errorf("argv for more = %q, want prompt ignored", got)
+	}
+}
+
+func TestOpenCloseLeaksNoFDs(t *testing.T) {
+	testPager(t, "cat >/dev/null")
+	cycle := func() {
+		t.Helper()
+		if err := Open(); err != nil {
+			t.Fatal(err)
+		}
+		running := p != nil
+		fmt.Println("hello from my pager!")
+		if err := Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !running {
+			t.Fatal("Open didn't start a pager")
+		}
+	}
+	// The first cycle may open descriptors the runtime keeps, like the one
+	// for its poller.
+	cycle()
+	before := countFDs(t)
+	for i := 0; i < 50; i++ {
+		cycle()
+	}
+	if after := countFDs(t); after != before {
+		t.Errorf("open fds went from %d to %d over 50 Open/Close cycles", before, after)
+	}
+}
+
+func TestMaxDuration(t *testing.T) {
+	testPager(t, "exec sleep 10")
+	start := time.Now()
+	if err := Open(WithMaxDuration(50 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Close(); err != nil {
+		t.Errorf("Close after WithMaxDuration expired = %v, want nil", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("pager ran for %v, want it terminated after 50ms", d)
+	}
+}
+
+func TestRestoreOnExit(t *testing.T) {
+	testPager(t, "exit 0")
+	if err := Open(WithRestoreOnExit(true)); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for IsRedirected() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	redirected := IsRedirected()
+	// Without the restore this would kill the test with SIGPIPE.
+	_, werr := fmt.Println("after the pager quit")
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	if redirected {
+		t.Fatal("output still redirected after the pager exited")
+	}
+	if werr != nil {
+		t.Errorf("write after the pager exited: %v", werr)
+	}
+}
+
+func BenchmarkOpenNotTerminal(b *testing.B) {
+	old := isTerminal
+	isTerminal = func(uintptr) bool { return false }
+	defer func() { isTerminal = old }()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := Open(); err != nil {
+			b.Fatal(err)
+		}
+		Close()
+	}
+}
+
+func TestEnvLess(t *testing.T) {
+	setenv(t, "NO_COLOR", "")
+	setenv(t, "LESS", "")
+	os.Unsetenv("LESS")
+	if got, _ := lookupEnv(newOptions(nil).env(), "LESS"); got != "FRSM" {
+		t.Errorf("default LESS = %q, want %q", got, "FRSM")
+	}
+	if got, _ := lookupEnv(newOptions([]Option{WithLongPrompt(false)}).env(), "LESS"); got != "FRS" {
+		t.Errorf("LESS with WithLongPrompt(false) = %q, want %q", got, "FRS")
+	}
+	if got, _ := lookupEnv(newOptions([]Option{WithAlwaysStayOpen(true)}).env(), "LESS"); got != "RSM" {
+		t.Errorf("LESS with WithAlwaysStayOpen(true) = %q, want %q", got, "RSM")
+	}
+	setenv(t, "LESS", "-i")
+	if got, _ := lookupEnv(newOptions(nil).env(), "LESS"); got != "-i" {
+		t.Errorf("LESS with user value = %q, want %q", got, "-i")
+	}
+	if got, _ := lookupEnv(newOptions([]Option{WithRawLessEnv("X")}).env(), "LESS"); got != "X" {
+		t.Errorf("LESS with WithRawLessEnv = %q, want %q", got, "X")
+	}
+}
+
+func TestCandidatesDefaultArgs(t *testing.T) {
+	setenv(t, "PAGER", "most -s")
+	setenv(t, "PAGER_DEFAULT_ARGS", `-R '-Ps hi'`)
+	cs, err := candidates(newOptions([]Option{WithFallbacks("less")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []candidate{
+		{"most", []string{"most", "-s"}},
+		{"less", []string{"less", "-R", "-Ps hi"}},
+	}
+	if !reflect.DeepEqual(cs, want) {
+		t.Errorf("candidates = %q, want %q", cs, want)
+	}
+}
+
+func TestCapture(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	testPager(t, "cat >"+out)
+	var capture bytes.Buffer
+	if err := Open(WithCapture(&capture)); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Print("to stdout\n")
+	fmt.Fprint(os.Stderr, "to stderr\n")
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	const want = "to stdout\nto stderr\n"
+	if got := capture.String(); got != want {
+		t.Errorf("captured %q, want %q", got, want)
+	}
+	if got, err := os.ReadFile(out); err != nil || string(got) != want {
+		t.Errorf("pager read %q, %v, want %q", got, err, want)
+	}
+}
+
+func TestStoredFDsCloseOnExec(t *testing.T) {
+	testPager(t, "cat >/dev/null")
+	if err := Open(); err != nil {
+		t.Fatal(err)
+	}
+	var flags []int
+	for _, fd := range []int{p.storedStdout, p.storedStderr} {
+		f, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0)
+		if err != nil {
+			f = -1
+		}
+		flags = append(flags, f)
+	}
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i, f := range flags {
+		if f < 0 || f&unix.FD_CLOEXEC == 0 {
+			t.Errorf("stored fd %d flags = %#x, want FD_CLOEXEC", i, f)
+		}
+	}
+}
+
+func TestQuit(t *testing.T) {
+	testPager(t, "exec sleep 10")
+	start := time.Now()
+	if err := Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Quit(); err != nil {
+		t.Errorf("Quit = %v, want nil", err)
+	}
+	if IsRedirected() {
+		t.Error("output still redirected after Quit")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("pager ran for %v after Quit", d)
+	}
+}
+
+func TestQuitSignal(t *testing.T) {
+	dir := t.TempDir()
+	out, ready := filepath.Join(dir, "out"), filepath.Join(dir, "ready")
+	testPager(t, trapScript("USR1", out, ready))
+	if err := Open(WithQuitSignal(unix.SIGUSR1)); err != nil {
+		t.Fatal(err)
+	}
+	waitForFile(t, ready)
+	if err := Quit(); err != nil {
+		t.Errorf("Quit = %v, want nil", err)
+	}
+	if got, err := os.ReadFile(out); err != nil || string(got) != "USR1\n" {
+		t.Errorf("pager recorded %q, %v, want SIGUSR1", got, err)
+	}
+}
+
+func TestQuitDuringClose(t *testing.T) {
+	testPager(t, "cat >/dev/null; exec sleep 10")
+	start := time.Now()
+	if err := Open(); err != nil {
+		t.Fatal(err)
+	}
+	quit := make(chan error, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		quit <- Quit()
+	}()
+	if err := Close(); err != nil {
+		t.Errorf("Close = %v, want nil", err)
+	}
+	if err := <-quit; err != nil {
+		t.Errorf("Quit = %v, want nil", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("pager ran for %v after Quit", d)
+	}
+	// The session is gone, so the next one starts afresh.
+	if reused, err := EnsureOpen(); err != nil || reused {
+		t.Errorf("EnsureOpen after Quit = %v, %v, want a new pager", reused, err)
+	}
+	Reset()
+}
+
+func TestEnvMultiplexer(t *testing.T) {
+	setenv(t, "TMUX", "/tmp/tmux-1000/default,1234,0")
+	setenv(t, "LESS", "-i")
+	o := newOptions([]Option{WithMultiplexerAware(true)})
+	if got, _ := lookupEnv(o.env(), "LESS"); got != "-R -i" {
+		t.Errorf("LESS under tmux = %q, want %q", got, "-R -i")
+	}
+	if got, _ := lookupEnv(newOptions(nil).env(), "LESS"); got != "-i" {
+		t.Errorf("LESS under tmux without WithMultiplexerAware = %q, want %q", got, "-i")
+	}
+}
+
+func TestCandidatesBlankPager(t *testing.T) {
+	setenv(t, "PAGER", "   ")
+	cs, err := candidates(newOptions([]Option{WithFallbacks("less")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := candidateNames(cs), []string{"less"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("candidates = %q, want %q", got, want)
+	}
+}
+
+func TestPostProcess(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	testPager(t, "cat >"+out)
+	for _, tc := range []struct {
+		name string
+		opt  Option
+		want string
+	}{
+		{"sort", WithPostProcess("sort"), "a\nb\n"},
+		// Failing before writing anything falls back to the output as is.
+		{"failing", WithPostProcess("false"), "b\na\n"},
+		{"missing", WithPostProcess(filepath.Join(t.TempDir(), "missing")), "b\na\n"},
+	} {
+		if err := Open(tc.opt, WithQuiet(true)); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		fmt.Print("b\na\n")
+		if err := Close(); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got, err := os.ReadFile(out); err != nil || string(got) != tc.want {
+			t.Errorf("%s: pager read %q, %v, want %q", tc.name, got, err, tc.want)
+		}
+	}
+}
+
+func TestPreFilter(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	testPager(t, "cat >"+out)
+	var capture bytes.Buffer
+	if err := Open(WithPreFilter("tr", "a-z", "A-Z"), WithCapture(&capture)); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Println("hello from my pager!")
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(out); err != nil || string(got) != "HELLO FROM MY PAGER!\n" {
+		t.Errorf("pager read %q, %v, want the filtered output", got, err)
+	}
+	// Capturing happens before filtering.
+	if got := capture.String(); got != "hello from my pager!\n" {
+		t.Errorf("captured %q, want the unfiltered output", got)
+	}
+}
+
+func TestEnvNoColor(t *testing.T) {
+	setenv(t, "NO_COLOR", "1")
+	setenv(t, "TMUX", "/tmp/tmux-1000/default,1234,0")
+	setenv(t, "LESS", "")
+	os.Unsetenv("LESS")
+	o := newOptions([]Option{WithMultiplexerAware(true)})
+	if got, _ := lookupEnv(o.env(), "LESS"); got != "FSM" {
+		t.Errorf("LESS with NO_COLOR = %q, want %q", got, "FSM")
+	}
+	o = newOptions([]Option{WithMultiplexerAware(true), WithRawLessEnv("R")})
+	if got, _ := lookupEnv(o.env(), "LESS"); got != "R" {
+		t.Errorf("LESS with NO_COLOR and WithRawLessEnv = %q, want %q", got, "R")
+	}
+}
+
+func TestANSIStripper(t *testing.T) {
+	var out bytes.Buffer
+	a := &ansiStripper{w: &out}
+	in := "\x1b[1;31mred\x1b[0m \x1b]8;;http://x\x1b\\link\x1b]8;;\x07 \x1b(Bplain\n"
+	// Write a byte at a time so that every sequence is split.
+	for i := 0; i < len(in); i++ {
+		if _, err := a.Write([]byte{in[i]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := out.String(), "red link plain\n"; got != want {
+		t.Errorf("stripped %q, want %q", got, want)
+	}
+}
+
+func TestNoColorStrip(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	testPager(t, "cat >"+out)
+	setenv(t, "NO_COLOR", "1")
+	var capture bytes.Buffer
+	if err := Open(WithNoColorStrip(true), WithCapture(&capture)); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Print("\x1b[32mgreen\x1b[0m\n")
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(out); err != nil || string(got) != "green\n" {
+		t.Errorf("pager read %q, %v, want the output without colors", got, err)
+	}
+	if got := capture.String(); got != "\x1b[32mgreen\x1b[0m\n" {
+		t.Errorf("captured %q, want the output as written", got)
+	}
+}
+
+func TestPagerSupportsColor(t *testing.T) {
+	dir := t.TempDir()
+	pager := filepath.Join(dir, "pager")
+	if err := os.Symlink("/bin/more", pager); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{
+		"less":          true,
+		"/usr/bin/bat":  true,
+		"most":          true,
+		"more":          false,
+		"/usr/bin/more": false,
+		pager:           false,
+	} {
+		if got := PagerSupportsColor(name); got != want {
+			t.Errorf("PagerSupportsColor(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestNoColorStripMore(t *testing.T) {
+	dir := t.TempDir()
+	more, out := filepath.Join(dir, "more"), filepath.Join(dir, "out")
+	if err := os.WriteFile(more, []byte("#!/bin/sh\ncat >"+out+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	testPager(t, "")
+	setenv(t, "PAGER", more)
+	setenv(t, "NO_COLOR", "")
+	if err := Open(WithNoColorStrip(true)); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Print("\x1b[32mgreen\x1b[0m\n")
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(out); err != nil || string(got) != "green\n" {
+		t.Errorf("more read %q, %v, want the output without colors", got, err)
+	}
+}
+
+func TestOpenContext(t *testing.T) {
+	testPager(t, "exit 0")
+	ctx, err := OpenContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Error("context not cancelled after the pager exited")
+	}
+	Close()
+}
+
+func TestOpenContextNotTerminal(t *testing.T) {
+	old := isTerminal
+	isTerminal = func(uintptr) bool { return false }
+	defer func() { isTerminal = old }()
+	parent := context.Background()
+	ctx, err := OpenContext(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+	if ctx != parent {
+		t.Error("OpenContext without a pager didn't return parent")
+	}
+}
+
+func TestCandidatesProvider(t *testing.T) {
+	setenv(t, "PAGER", "less")
+	provide := func(ok bool) Option {
+		return WithPagerProvider(func() (string, []string, bool) {
+			return "most", []string{"-s"}, ok
+		})
+	}
+	cs, err := candidates(newOptions([]Option{provide(true), WithFallbacks("most", "more")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []candidate{
+		{"most", []string{"most", "-s"}},
+		{"less", []string{"less"}},
+		{"more", []string{"more"}},
+	}
+	if !reflect.DeepEqual(cs, want) {
+		t.Errorf("candidates = %q, want %q", cs, want)
+	}
+	cs, err = candidates(newOptions([]Option{provide(false), WithFallbacks("more")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := candidateNames(cs), []string{"less", "more"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("candidates when the provider declines = %q, want %q", got, want)
+	}
+}
+
+func TestArgvNoInitialClear(t *testing.T) {
+	o := newOptions([]Option{WithNoInitialClear(true)})
+	c := candidate{"less", []string{"less", "-R"}}
+	if got, want := o.argv("/usr/bin/less", c), []string{"less", "-R", "-X"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("argv = %q, want %q", got, want)
+	}
+	if !reflect.DeepEqual(c.args, []string{"less", "-R"}) {
+		t.Errorf("argv changed the candidate's args to %q", c.args)
+	}
+	if got := o.argv("/bin/more", candidate{"more", []string{"more"}}); !reflect.DeepEqual(got, []string{"more"}) {
+		t.Errorf("argv for more = %q, want the option ignored", got)
+	}
+}
+
+func TestCandidatesEnvPrecedence(t *testing.T) {
+	setenv(t, "PAGER", "less")
+	setenv(t, "GIT_PAGER", " ")
+	setenv(t, "MANPAGER", `most '-s'`)
+	o := newOptions([]Option{WithEnvPrecedence("GIT_PAGER", "MANPAGER", "PAGER"), WithFallbacks()})
+	cs, err := candidates(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []candidate{{"most", []string{"most", "-s"}}}; !reflect.DeepEqual(cs, want) {
+		t.Errorf("candidates = %q, want %q", cs, want)
+	}
+	cs, err = candidates(newOptions([]Option{WithEnvPrecedence(), WithFallbacks()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cs) != 0 {
+		t.Errorf("candidates without env vars = %q, want none", cs)
+	}
+	setenv(t, "GIT_PAGER", "'less")
+	if _, err := candidates(o); err == nil {
+		t.Error("candidates succeeded with an unterminated quote in GIT_PAGER")
+	}
+}
+
+func TestStrict(t *testing.T) {
+	testPager(t, "")
+	dir := t.TempDir()
+	loop := filepath.Join(dir, "loop")
+	if err := os.Symlink(loop, loop); err != nil {
+		t.Fatal(err)
+	}
+	fifo := filepath.Join(dir, "fifo")
+	if err := unix.Mkfifo(fifo, 0755); err != nil {
+		t.Skip(err)
+	}
+	for _, pager := range []string{loop, fifo} {
+		setenv(t, "PAGER", pager)
+		if err := Open(WithFallbacks(), WithStrict(true)); err == nil {
+			Close()
+			t.Errorf("Open with PAGER=%s and WithStrict succeeded", pager)
+		}
+		if err := Open(WithFallbacks()); err != nil {
+			t.Errorf("Open with PAGER=%s = %v, want nil", pager, err)
+		}
+		if p != nil {
+			t.Errorf("Open started PAGER=%s", pager)
+		}
+		Close()
+	}
+	// A pager that isn't installed isn't an error.
+	setenv(t, "PAGER", filepath.Join(dir, "missing"))
+	if err := Open(WithFallbacks(), WithStrict(true)); err != nil {
+		t.Errorf("Open with a missing PAGER and WithStrict = %v, want nil", err)
+	}
+	Close()
+}
+
+func TestQuiet(t *testing.T) {
+	testPager(t, "")
+	// An empty PAGER means no paging, so leave it unset for the fallbacks.
+	setenv(t, "PAGER", "")
+	os.Unsetenv("PAGER")
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	if err := Open(WithFallbacks(), WithQuiet(true)); err != nil {
+		t.Fatal(err)
+	}
+	Close()
+	if logged.Len() != 0 {
+		t.Errorf("Open with WithQuiet logged %q", logged.String())
+	}
+	if err := Open(WithFallbacks()); err != nil {
+		t.Fatal(err)
+	}
+	Close()
+	if logged.Len() == 0 {
+		t.Error("Open without WithQuiet didn't log that no pager was found")
+	}
+}
+
+func TestPageStderrOnly(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	testPager(t, "cat >"+out)
+	isTerminal = func(fd uintptr) bool { return fd == uintptr(unix.Stderr) }
+	if err := Open(); err != nil {
+		t.Fatal(err)
+	}
+	if p != nil {
+		Close()
+		t.Fatal("Open started a pager with stdout not a terminal")
+	}
+	var before, during unix.Stat_t
+	if err := unix.Fstat(unix.Stdout, &before); err != nil {
+		t.Fatal(err)
+	}
+	if err := Open(WithPageStderrOnly(true)); err != nil {
+		t.Fatal(err)
+	}
+	err := unix.Fstat(unix.Stdout, &during)
+	fmt.Fprint(os.Stderr, "to stderr\n")
+	if cerr := Close(); cerr != nil {
+		t.Fatal(cerr)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if during.Dev != before.Dev || during.Ino != before.Ino {
+		t.Error("stdout redirected with WithPageStderrOnly")
+	}
+	if got, err := os.ReadFile(out); err != nil || string(got) != "to stderr\n" {
+		t.Errorf("pager read %q, %v, want the output to stderr", got, err)
+	}
+}
+
+func TestStreamsStdoutOnly(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	testPager(t, "cat >"+out)
+	isTerminal = func(fd uintptr) bool { return fd == uintptr(unix.Stdout) }
+	var before, during unix.Stat_t
+	if err := unix.Fstat(unix.Stderr, &before); err != nil {
+		t.Fatal(err)
+	}
+	if err := Open(WithStreams(StdoutOnly)); err != nil {
+		t.Fatal(err)
+	}
+	if p == nil {
+		t.Fatal("Open didn't start a pager with stdout a terminal")
+	}
+	err := unix.Fstat(unix.Stderr, &during)
+	fmt.Fprint(os.Stdout, "to stdout\n")
+	if cerr := Close(); cerr != nil {
+		t.Fatal(cerr)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if during.Dev != before.Dev || during.Ino != before.Ino {
+		t.Error("stderr redirected with StdoutOnly")
+	}
+	if got, err := os.ReadFile(out); err != nil || string(got) != "to stdout\n" {
+		t.Errorf("pager read %q, %v, want the output to stdout", got, err)
+	}
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	testPager(t, "cat >/dev/null")
+	setenv(t, "LESS", "-i")
+	setenv(t, "LESSCHARSET", "")
+	os.Unsetenv("LESSCHARSET")
+	setenv(t, "NO_COLOR", "")
+	setenv(t, "LC_ALL", "en_US.UTF-8")
+	if err := Open(WithRestoreOnExit(true), WithPrompt("hi"), WithFallbacks("more")); err != nil {
+		t.Fatal(err)
+	}
+	c := EffectiveConfig()
+	path, _ := SelectedPager()
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Path != path {
+		t.Errorf("Path = %q, want %q", c.Path, path)
+	}
+	if !reflect.DeepEqual(c.Env, []string{"LESSCHARSET=utf-8"}) {
+		t.Errorf("Env = %q, want just LESSCHARSET", c.Env)
+	}
+	if !reflect.DeepEqual(c.Flags, []string{"WithRestoreOnExit"}) || c.Prompt != "hi" {
+		t.Errorf("Flags = %q, Prompt = %q", c.Flags, c.Prompt)
+	}
+	if !reflect.DeepEqual(c.Fallbacks, []string{"more"}) {
+		t.Errorf("Fallbacks = %q, want %q", c.Fallbacks, []string{"more"})
+	}
+	if c := EffectiveConfig(); !reflect.DeepEqual(c, Config{}) {
+		t.Errorf("EffectiveConfig after Close = %+v, want the zero Config", c)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	testPager(t, "cat >/dev/null")
+	setenv(t, "LESS", "-i")
+	setenv(t, "LESSCHARSET", "")
+	os.Unsetenv("LESSCHARSET")
+	setenv(t, "LC_ALL", "en_US.UTF-8")
+	pager := os.Getenv("PAGER")
+	plan, err := Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsRedirected() {
+		t.Error("Plan redirected output")
+	}
+	want := PagingPlan{
+		Page: true,
+		Path: pager,
+		Argv: []string{"testpager"},
+		Env:  []string{"LESSCHARSET=utf-8"},
+	}
+	if !reflect.DeepEqual(plan, want) {
+		t.Errorf("Plan = %+v, want %+v", plan, want)
+	}
+	if err := Open(); err != nil {
+		t.Fatal(err)
+	}
+	plan, err = Plan(WithFallbacks("more"))
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	if want.Reused = true; err != nil || !reflect.DeepEqual(plan, want) {
+		t.Errorf("Plan while paging = %+v, %v, want %+v", plan, err, want)
+	}
+	isTerminal = func(uintptr) bool { return false }
+	if plan, err := Plan(); err != nil || plan.Page || plan.Reason != "stdout or stderr isn't a terminal" {
+		t.Errorf("Plan off a terminal = %+v, %v", plan, err)
+	}
+	if _, err := Plan(WithForce(true), WithFallbacks(""), WithIgnoreEnv(true)); err == nil {
+		t.Error("Plan succeeded with an empty fallback name")
+	}
+}
+
+func TestStdoutStderrPagers(t *testing.T) {
+	testPager(t, "")
+	dir := t.TempDir()
+	outFile, errFile := filepath.Join(dir, "out"), filepath.Join(dir, "err")
+	err := Open(WithStdoutPager("sh", "-c", "cat >"+outFile), WithStderrPager("sh", "-c", "cat >"+errFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Println("to stdout")
+	fmt.Fprintln(os.Stderr, "to stderr")
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(outFile); err != nil || string(got) != "to stdout\n" {
+		t.Errorf("stdout pager read %q, %v, want just stdout", got, err)
+	}
+	if got, err := os.ReadFile(errFile); err != nil || string(got) != "to stderr\n" {
+		t.Errorf("stderr pager read %q, %v, want just stderr", got, err)
+	}
+
+	// Quit ends both.
+	start := time.Now()
+	if err := Open(WithStdoutPager("sleep", "10"), WithStderrPager("sleep", "10")); err != nil {
+		t.Fatal(err)
+	}
+	if err := Quit(); err != nil {
+		t.Errorf("Quit = %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Quit took %v", d)
+	}
+}
+
+func TestPlanLessFlags(t *testing.T) {
+	testPager(t, "")
+	dir := t.TempDir()
+	ran := filepath.Join(dir, "ran")
+	less := filepath.Join(dir, "less")
+	if err := os.WriteFile(less, []byte("#!/bin/sh\ntouch "+ran+"\necho less 600\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	setenv(t, "PAGER", less)
+	plan, err := Plan(WithLessFlag("--incsearch", 550))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(ran); err == nil {
+		t.Error("Plan ran the pager")
+	}
+	if !reflect.DeepEqual(plan.Argv, []string{"less"}) {
+		t.Errorf("Argv = %q, want just less", plan.Argv)
+	}
+	if want := map[string]int{"--incsearch": 550}; !reflect.DeepEqual(plan.LessFlags, want) {
+		t.Errorf("LessFlags = %v, want %v", plan.LessFlags, want)
+	}
+}
+
+// TestConfigFlags checks that Config.Flags has an entry for every boolean
+// option, so that one added later isn't left out.
+func TestConfigRoundTrip(t *testing.T) {
+	// These take funcs, writers, files, channels or signals, which Config
+	// leaves out, and noVersionProbe is set by Plan.
+	skip := map[string]bool{
+		"timings": true, "onInterrupt": true, "closeSignal": true,
+		"capture": true, "quitSignal": true, "abortOnWriteError": true,
+		"fitCalculator": true, "provider": true, "preSpawn": true,
+		"logger": true, "pagerStderr": true, "flush": true,
+		"exitCodeHandler": true, "signalChan": true, "noVersionProbe": true,
+	}
+	defaults := newOptions(nil).config()
+	typ := reflect.TypeOf(options{})
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if skip[field.Name] {
+			continue
+		}
+		o := newOptions(nil)
+		v := reflect.ValueOf(o).Elem().Field(i)
+		v = reflect.NewAt(v.Type(), unsafe.Pointer(v.UnsafeAddr())).Elem()
+		switch v.Kind() {
+		case reflect.Bool:
+			v.SetBool(!v.Bool())
+		case reflect.Int, reflect.Int64:
+			v.SetInt(1)
+		case reflect.String:
+			v.SetString("x")
+		case reflect.Slice:
+			v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+		case reflect.Map:
+			m := reflect.MakeMap(v.Type())
+			m.SetMapIndex(reflect.ValueOf("x"), reflect.Zero(v.Type().Elem()))
+			v.Set(m)
+		case reflect.Ptr:
+			v.Set(reflect.New(v.Type().Elem()))
+		default:
+			t.Fatalf("options.%s has a %v, which the test can't set", field.Name, v.Kind())
+		}
+		c := o.config()
+		if reflect.DeepEqual(c, defaults) {
+			t.Errorf("Config has no trace of options.%s", field.Name)
+			continue
+		}
+		b, err := json.Marshal(c)
+		if err != nil {
+			t.Fatalf("marshaling the Config for options.%s: %v", field.Name, err)
+		}
+		var got Config
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatalf("unmarshaling %s: %v", b, err)
+		}
+		if got := newOptions([]Option{WithConfig(got)}).config(); !reflect.DeepEqual(got, c) {
+			t.Errorf("options.%s: WithConfig of %s gave %+v, want %+v", field.Name, b, got, c)
+		}
+	}
+}
+
+func TestStreamsText(t *testing.T) {
+	for _, s := range []Streams{Both, StdoutOnly, StderrOnly} {
+		text, err := s.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Streams
+		if err := got.UnmarshalText(text); err != nil || got != s {
+			t.Errorf("UnmarshalText(%q) = %v, %v, want %v", text, got, err, s)
+		}
+	}
+	var s Streams
+	if err := s.UnmarshalText([]byte("neither")); err == nil {
+		t.Error("UnmarshalText of an unknown name succeeded")
+	}
+}
+
+func TestRetryEINTR(t *testing.T) {
+	calls := 0
+	err := retryEINTR(func() error {
+		if calls++; calls < 3 {
+			return unix.EINTR
+		}
+		return unix.EBADF
+	})
+	if err != unix.EBADF || calls != 3 {
+		t.Errorf("retryEINTR = %v after %d calls, want EBADF after 3", err, calls)
+	}
+}
+
+func TestCandidatesContentType(t *testing.T) {
+	setenv(t, "PAGER", "")
+	setenv(t, "PAGER_DEFAULT_ARGS", "-R")
+	pagers := WithContentTypePagers(map[string][]string{
+		"text/x-go": {"bat --language=go", "less"},
+		"text/*":    {"most"},
+	})
+	for _, tc := range []struct {
+		contentType string
+		want        []candidate
+	}{
+		{"text/x-go; charset=utf-8", []candidate{
+			{"bat", []string{"bat", "--language=go"}},
+			{"less", []string{"less"}},
+			{"more", []string{"more", "-R"}},
+		}},
+		{"Text/Plain", []candidate{
+			{"most", []string{"most"}},
+			{"less", []string{"less", "-R"}},
+			{"more", []string{"more", "-R"}},
+		}},
+		{"image/png", []candidate{
+			{"less", []string{"less", "-R"}},
+			{"more", []string{"more", "-R"}},
+		}},
+	} {
+		o := newOptions([]Option{pagers, WithContentType(tc.contentType), WithFallbacks("less", "more")})
+		cs, err := candidates(o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(cs, tc.want) {
+			t.Errorf("candidates for %s = %q, want %q", tc.contentType, cs, tc.want)
+		}
+	}
+}
+
+// defaultInterrupt undoes earlier tests leaving SIGINT ignored after Close. As
+// in Reset, notifying makes signal.Ignored report the default handling.
+func defaultInterrupt() {
+	signal.Notify(make(chan os.Signal, 1), os.Interrupt)
+	signal.Reset(os.Interrupt)
+}
+
+func TestReset(t *testing.T) {
+	// Safe with nothing open.
+	Reset()
+	testPager(t, "trap '' TERM; exec sleep 10")
+	defaultInterrupt()
+	ignored := signal.Ignored(os.Interrupt)
+	var before, after unix.Stat_t
+	if err := unix.Fstat(unix.Stdout, &before); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := Open(); err != nil {
+		t.Fatal(err)
+	}
+	Reset()
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Reset took %v", d)
+	}
+	if p != nil || IsRedirected() {
+		t.Error("pager still open after Reset")
+	}
+	if err := unix.Fstat(unix.Stdout, &after); err != nil {
+		t.Fatal(err)
+	}
+	if after.Dev != before.Dev || after.Ino != before.Ino {
+		t.Error("stdout not restored by Reset")
+	}
+	if signal.Ignored(os.Interrupt) != ignored {
+		t.Error("SIGINT handling not restored by Reset")
+	}
+}
+
+func TestForwardInterrupt(t *testing.T) {
+	// The pager ignores the interrupt, so Close waits out the sleep.
+	testPager(t, "trap '' INT; cat >/dev/null; exec sleep 0.3")
+	interrupted := make(chan struct{}, 1)
+	err := Open(WithForwardInterrupt(true), WithOnInterrupt(func() { interrupted <- struct{}{} }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signalDuringClose(unix.SIGINT)
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-interrupted:
+	default:
+		t.Error("interrupt during Close not forwarded")
+	}
+}
+
+func TestSerializedWrites(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	testPager(t, "cat >"+out)
+	stderr := os.Stderr
+	if err := Open(WithSerializedWrites(true)); err != nil {
+		t.Fatal(err)
+	}
+	// Each goroutine writes blocks of its own letter, much larger than
+	// PIPE_BUF, half of them through each of stdout and stderr.
+	const size, writes = 256 << 10, 4
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			block := bytes.Repeat([]byte{byte('a' + i)}, size)
+			for j := 0; j < writes; j++ {
+				f := os.Stdout
+				if (i+j)%2 == 0 {
+					f = os.Stderr
+				}
+				f.Write(block)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	if os.Stderr != stderr {
+		t.Error("os.Stderr not restored by Close")
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 8*writes*size {
+		t.Fatalf("pager read %d bytes, want %d", len(got), 8*writes*size)
+	}
+	for i := 0; i < len(got); i += size {
+		block := got[i : i+size]
+		if bytes.Count(block, block[:1]) != size {
+			t.Fatalf("write at offset %d was interleaved with another", i)
+		}
+	}
+	// These would set os.Stderr back from a goroutine of their own.
+	for _, opt := range []Option{WithRestoreOnExit(true), WithMaxDuration(time.Minute), WithHangupHandling(true)} {
+		if err := Open(WithSerializedWrites(true), opt); err != ErrSerializedAsync {
+			t.Errorf("Open = %v, want ErrSerializedAsync", err)
+		}
+		if IsRedirected() {
+			t.Error("output redirected after a failed Open")
+			Reset()
+		}
+	}
+}
+
+func TestEnvCharset(t *testing.T) {
+	setenv(t, "LESSCHARSET", "")
+	os.Unsetenv("LESSCHARSET")
+	setenv(t, "LC_ALL", "")
+	setenv(t, "LC_CTYPE", "")
+	for _, tc := range []struct {
+		lang, want string
+	}{
+		{"", "utf-8"},
+		{"C", "utf-8"},
+		{"en_US.UTF-8", "utf-8"},
+		{"de_DE.utf8@euro", "utf-8"},
+		{"de_DE.ISO-8859-1", ""},
+		{"ja_JP", ""},
+	} {
+		setenv(t, "LANG", tc.lang)
+		if got, _ := lookupEnv(newOptions(nil).env(), "LESSCHARSET"); got != tc.want {
+			t.Errorf("LESSCHARSET with LANG=%s = %q, want %q", tc.lang, got, tc.want)
+		}
+	}
+	setenv(t, "LC_CTYPE", "en_US.UTF-8")
+	if got, _ := lookupEnv(newOptions(nil).env(), "LESSCHARSET"); got != "utf-8" {
+		t.Errorf("LESSCHARSET with LC_CTYPE overriding LANG = %q, want %q", got, "utf-8")
+	}
+	setenv(t, "LESSCHARSET", "dos")
+	if got, _ := lookupEnv(newOptions([]Option{WithCharset("latin1")}).env(), "LESSCHARSET"); got != "latin1" {
+		t.Errorf("LESSCHARSET with WithCharset = %q, want %q", got, "latin1")
+	}
+}
+
+func TestNoCharset(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	testPager(t, `echo "${LESSCHARSET-unset}" >`+out+"; cat >/dev/null")
+	setenv(t, "LESSCHARSET", "")
+	os.Unsetenv("LESSCHARSET")
+	setenv(t, "LC_ALL", "en_US.UTF-8")
+	if err := Open(WithNoCharset(true), WithCharset("latin1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(out); err != nil || string(got) != "unset\n" {
+		t.Errorf("pager got LESSCHARSET %q, %v, want it unset", got, err)
+	}
+}
+
+func TestPreSpawn(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	testPager(t, `echo "$PRESPAWN $1" >`+out+"; cat >/dev/null")
+	pager := os.Getenv("PAGER")
+	spawn := func(path string, argv, env []string) (string, []string, []string, error) {
+		if path != pager {
+			return "", nil, nil, fmt.Errorf("hook got path %q, want %q", path, pager)
+		}
+		return path, append(argv, "arg"), append(env, "PRESPAWN=set"), nil
+	}
+	if err := Open(WithPreSpawn(spawn)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(out); err != nil || string(got) != "set arg\n" {
+		t.Errorf("pager recorded %q, %v, want the hook's changes", got, err)
+	}
+
+	veto := errors.New("vetoed")
+	err := Open(WithPreSpawn(func(string, []string, []string) (string, []string, []string, error) {
+		return "", nil, nil, veto
+	}))
+	if err != veto {
+		Close()
+		t.Errorf("Open with a vetoing hook = %v, want %v", err, veto)
+	}
+}
+
+func TestPassthroughCat(t *testing.T) {
+	testPager(t, "")
+	cat, err := exec.LookPath("cat")
+	if err != nil {
+		t.Skip(err)
+	}
+	setenv(t, "PAGER", cat)
+	if err := Open(); err != nil {
+		t.Fatal(err)
+	}
+	passthrough, ignoring := p.passthrough, p.ignoringInterrupt
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !passthrough {
+		t.Error("cat not treated as a passthrough pager")
+	}
+	if ignoring {
+		t.Error("SIGINT ignored while cat ran")
+	}
+}
+
+func TestIsDumbTerminal(t *testing.T) {
+	for term, want := range map[string]bool{"": true, "dumb": true, "xterm": false, "screen-256color": false} {
+		if got := IsDumbTerminal(term); got != want {
+			t.Errorf("IsDumbTerminal(%q) = %v, want %v", term, got, want)
+		}
+	}
+}
+
+func TestDone(t *testing.T) {
+	select {
+	case <-Done():
+	default:
+		t.Error("Done without a pager isn't closed")
+	}
+	testPager(t, "exit 0")
+	if err := Open(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-Done():
+	case <-time.After(5 * time.Second):
+		t.Error("Done not closed after the pager exited")
+	}
+	Close()
+
+	// Another goroutine may ask while Close waits for the user, without
+	// racing with it or waiting for it.
+	testPager(t, "cat >/dev/null; exec sleep 0.2")
+	if err := Open(); err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan struct{})
+	asked := make(chan struct{})
+	go func() {
+		defer close(asked)
+		for {
+			Done()
+			SelectedPager()
+			IsRedirected()
+			PipeWriter()
+			EffectiveConfig()
+			select {
+			case <-closed:
+				return
+			default:
+			}
+		}
+	}()
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	close(closed)
+	<-asked
+}
+
+func TestPagerIsSelf(t *testing.T) {
+	testPager(t, "")
+	exe, err := os.Executable()
+	if err != nil {
+		t.Skip(err)
+	}
+	setenv(t, "PAGER", exe)
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	if err := Open(WithFallbacks()); err != nil {
+		t.Fatal(err)
+	}
+	started := p != nil
+	Close()
+	if started {
+		t.Fatal("Open started the test binary as the pager")
+	}
+	if !strings.Contains(logged.String(), "this program") {
+		t.Errorf("Open logged %q, want a warning about PAGER", logged.String())
+	}
+}
+
+func TestOpenVerbose(t *testing.T) {
+	testPager(t, "cat >/dev/null")
+	pager := os.Getenv("PAGER")
+	var logged bytes.Buffer
+	if err := OpenVerbose(log.New(&logged, "", 0), WithFallbacks()); err != nil {
+		t.Fatal(err)
+	}
+	pid := p.proc.Pid
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("PAGER=%q\ntrying %s\nstarted %s [\"testpager\"], pid %d\n", pager, pager, pager, pid)
+	if got := logged.String(); got != want {
+		t.Errorf("OpenVerbose logged %q, want %q", got, want)
+	}
+}
+
+func TestArgvLineNumbers(t *testing.T) {
+	o := newOptions([]Option{WithLineNumbers(true)})
+	if got, want := o.argv("/usr/bin/less", candidate{"less", []string{"less", "-R"}}), []string{"less", "-R", "-N"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("argv = %q, want %q", got, want)
+	}
+	// PAGER="less -N" isn't given a second -N.
+	if got, want := o.argv("/usr/bin/less", candidate{"less", []string{"less", "-N"}}), []string{"less", "-N"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("argv with -N already = %q, want %q", got, want)
+	}
+}
+
+func TestDisableEnvVar(t *testing.T) {
+	testPager(t, "cat >/dev/null")
+	o := newOptions([]Option{WithDisableEnvVar("MYAPP_NO_PAGER"), WithPageDumbTerminals(true)})
+	for v, want := range map[string]bool{"": true, "0": true, "no": true, "1": false, " Yes ": false, "TRUE": false} {
+		setenv(t, "MYAPP_NO_PAGER", v)
+		if got := shouldPage(o); got != want {
+			t.Errorf("shouldPage with MYAPP_NO_PAGER=%q = %v, want %v", v, got, want)
+		}
+	}
+}
+
+func TestNoPagerValues(t *testing.T) {
+	for _, v := range []string{"cat", ""} {
+		testPager(t, "cat >/dev/null")
+		setenv(t, "PAGER", v)
+		if err := Open(); err != nil {
+			t.Fatalf("Open with PAGER=%q: %v", v, err)
+		}
+		redirected := IsRedirected()
+		if err := Close(); err != nil {
+			t.Fatal(err)
+		}
+		if redirected {
+			t.Errorf("output redirected with PAGER=%q", v)
+		}
+	}
+	// Nothing but whitespace falls through to the fallbacks.
+	testPager(t, "cat >/dev/null")
+	fallback := os.Getenv("PAGER")
+	setenv(t, "PAGER", "   ")
+	if err := Open(WithFallbacks(fallback)); err != nil {
+		t.Fatal(err)
+	}
+	path, _ := SelectedPager()
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	if path != fallback {
+		t.Errorf("pager with a blank PAGER = %q, want the fallback %q", path, fallback)
+	}
+	for _, tc := range []struct {
+		pager string
+		opts  []Option
+		want  bool
+	}{
+		{"none", []Option{WithNoPagerValues("none")}, false},
+		{"cat", []Option{WithNoPagerValues("none")}, true},
+		{"", []Option{WithNoPagerValues()}, true},
+		{"/bin/cat", nil, true},
+		{"cat", []Option{WithPager("sh", "-c", "cat >/dev/null")}, true},
+		{"cat", []Option{WithEnvPrecedence("GIT_PAGER", "PAGER")}, false},
+	} {
+		setenv(t, "PAGER", tc.pager)
+		o := newOptions(tc.opts)
+		if got := shouldPage(o); got != tc.want {
+			t.Errorf("shouldPage with PAGER=%q and %d options = %v, want %v", tc.pager, len(tc.opts), got, tc.want)
+		}
+	}
+	// A GIT_PAGER naming a pager wins over PAGER=cat.
+	setenv(t, "GIT_PAGER", "less")
+	setenv(t, "PAGER", "cat")
+	if !shouldPage(newOptions([]Option{WithEnvPrecedence("GIT_PAGER", "PAGER")})) {
+		t.Error("GIT_PAGER=less with PAGER=cat not paged")
+	}
+}
+
+func TestCandidatesIgnoreEnv(t *testing.T) {
+	setenv(t, "PAGER", "most")
+	setenv(t, "PAGER_DEFAULT_ARGS", "-R")
+	cs, err := candidates(newOptions([]Option{WithIgnoreEnv(true), WithFallbacks("less")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []candidate{{"less", []string{"less"}}}; !reflect.DeepEqual(cs, want) {
+		t.Errorf("candidates = %q, want %q", cs, want)
+	}
+}
+
+func TestHangupHandling(t *testing.T) {
+	testPager(t, "cat >/dev/null; exec sleep 10")
+	start := time.Now()
+	if err := Open(WithHangupHandling(true)); err != nil {
+		t.Fatal(err)
+	}
+	// The terminal hangs up while the user reads the output, as when an
+	// ssh connection drops with less open.
+	signalDuringClose(unix.SIGHUP)
+	if err := Close(); err != ErrHangup {
+		t.Errorf("Close with a SIGHUP = %v, want ErrHangup", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("pager ran for %v after SIGHUP", d)
+	}
+}
+
+func TestParseLessVersion(t *testing.T) {
+	for out, want := range map[string]int{
+		"less 590 (GNU regular expressions)\nCopyright (C) 1984-2021": 590,
+		"less 551x (POSIX regular expressions)":                       551,
+		"less: unrecognized option: -":                                0,
+		"":                                                            0,
+	} {
+		if got := parseLessVersion([]byte(out)); got != want {
+			t.Errorf("parseLessVersion(%q) = %d, want %d", out, got, want)
+		}
+	}
+}
+
+func TestArgvLessFlag(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "less")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\necho less 530\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	o := newOptions([]Option{WithLessFlag("--mouse", 551), WithLessFlag("--no-keypad", 380)})
+	if got, want := o.argv(path, candidate{"less", []string{"less"}}), []string{"less", "--no-keypad"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("argv for less 530 = %q, want %q", got, want)
+	}
+}
+
+func TestEnsureOpen(t *testing.T) {
+	testPager(t, "cat >/dev/null")
+	if reused, err := EnsureOpen(); err != nil || reused {
+		t.Fatalf("first EnsureOpen = %v, %v, want false, nil", reused, err)
+	}
+	first := p
+	if reused, err := EnsureOpen(); err != nil || !reused {
+		t.Fatalf("second EnsureOpen = %v, %v, want true, nil", reused, err)
+	}
+	if p != first {
+		t.Error("second EnsureOpen started another pager")
+	}
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !IsRedirected() {
+		t.Error("pager closed before its last Close")
+	}
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	if p != nil {
+		t.Error("pager still running after its last Close")
+	}
+}
+
+func TestNestedOpen(t *testing.T) {
+	testPager(t, "cat >/dev/null")
+	for i := 0; i < 3; i++ {
+		if err := Open(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := p
+	for i := 0; i < 2; i++ {
+		if err := Close(); err != nil {
+			t.Fatal(err)
+		}
+		if p != first || !IsRedirected() {
+			t.Fatalf("pager closed by Close %d of 3", i+1)
+		}
+	}
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	if p != nil {
+		t.Error("pager still running after the last Close")
+	}
+	// Quit ends the pager however often it was opened.
+	Open()
+	Open()
+	if err := Quit(); err != nil {
+		t.Fatal(err)
+	}
+	if p != nil {
+		t.Error("pager still running after Quit")
+	}
+	if err := Close(); err != nil {
+		t.Errorf("Close after Quit = %v", err)
+	}
+}
+
+func TestRunPaged(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	testPager(t, "cat >"+out)
+	want := errors.New("failed")
+	err := RunPaged(func() error {
+		fmt.Println("hello from my pager!")
+		return want
+	})
+	var runErr *RunError
+	if !errors.As(err, &runErr) || runErr.FuncErr != want || runErr.PagerErr != nil || runErr.RestoreErr != nil {
+		t.Errorf("RunPaged = %#v, want a *RunError with FuncErr %v", err, want)
+	}
+	if !errors.Is(err, want) {
+		t.Errorf("errors.Is(%v, %v) = false", err, want)
+	}
+	if got, err := os.ReadFile(out); err != nil || string(got) != "hello from my pager!\n" {
+		t.Errorf("pager read %q, %v", got, err)
+	}
+	if err := RunPaged(func() error { return nil }); err != nil {
+		t.Errorf("RunPaged with nothing failing = %v", err)
+	}
+	// Each error is kept, and found by errors.As.
+	testPager(t, "cat >/dev/null; exit 3")
+	err = RunPaged(func() error { return want })
+	var exitErr *exec.ExitError
+	if !errors.As(err, &runErr) || runErr.FuncErr != want || !errors.As(runErr.PagerErr, &exitErr) {
+		t.Errorf("RunPaged with a failing pager = %#v, want both errors", err)
+	}
+	if !errors.As(err, &exitErr) {
+		t.Errorf("errors.As(%v, *exec.ExitError) = false", err)
+	}
+}
+
+func TestRunPagedPanic(t *testing.T) {
+	testPager(t, "cat >/dev/null")
+	defer func() {
+		if r := recover(); r != "oops" {
+			t.Errorf("recovered %v, want the panic from fn", r)
+		}
+		if p != nil || IsRedirected() {
+			t.Error("pager still running after fn panicked")
+		}
+	}()
+	RunPaged(func() error { panic("oops") })
+}
+
+func TestPagerAllowlist(t *testing.T) {
+	allowed := filepath.Join(t.TempDir(), "allowed")
+	if err := os.WriteFile(allowed, []byte("#!/bin/sh\ncat >/dev/null\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	testPager(t, "cat >/dev/null")
+	opts := []Option{WithFallbacks(allowed), WithPagerAllowlist([]string{"more", allowed})}
+	if err := Open(opts...); err != nil {
+		t.Fatal(err)
+	}
+	path, _ := SelectedPager()
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	if path != allowed {
+		t.Errorf("Open started %q, want the allowed fallback %q", path, allowed)
+	}
+	if err := Open(append(opts, WithStrict(true))...); err == nil {
+		Close()
+		t.Error("Open with a disallowed PAGER and WithStrict succeeded")
+	}
+	// Base names allow a pager anywhere.
+	if err := Open(WithFallbacks(), WithPagerAllowlist([]string{"testpager"})); err != nil {
+		t.Fatal(err)
+	}
+	path, _ = SelectedPager()
+	Close()
+	if filepath.Base(path) != "testpager" {
+		t.Errorf("Open started %q, want PAGER", path)
+	}
+}
+
+func TestCredential(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing user needs root")
+	}
+	testPager(t, "")
+	// The test's temporary directories are only readable by root.
+	setenv(t, "PAGER", `/bin/sh -c 'id -u >&2; cat >/dev/null'`)
+	var uid bytes.Buffer
+	cred := &syscall.Credential{Uid: 65534, Gid: 65534}
+	err := Page(func(io.Writer) error { return nil }, WithCredential(cred), WithPagerDiagnostics(&uid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(uid.String()); got != "65534" {
+		t.Errorf("pager ran as uid %q, want 65534", got)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	testPager(t, "cat >"+out)
+	var w *bufio.Writer
+	flushed := 0
+	flush := func() error {
+		flushed++
+		return w.Flush()
+	}
+	if err := Open(WithFlush(flush)); err != nil {
+		t.Fatal(err)
+	}
+	w = bufio.NewWriter(os.Stdout)
+	fmt.Fprintln(w, "hello from my pager!")
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	if flushed != 1 {
+		t.Errorf("flush called %d times, want 1", flushed)
+	}
+	if got, err := os.ReadFile(out); err != nil || string(got) != "hello from my pager!\n" {
+		t.Errorf("pager read %q, %v, want the buffered output", got, err)
+	}
+	want := errors.New("failed")
+	if err := Open(WithFlush(func() error { return want })); err != nil {
+		t.Fatal(err)
+	}
+	if err := Quit(); err != want {
+		t.Errorf("Quit = %v, want the error from flush", err)
+	}
+}
+
+func TestNoTTY(t *testing.T) {
+	testPager(t, "cat >/dev/null")
+	openTTY = func() error { return errors.New("no controlling terminal") }
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	if err := Open(); err != nil {
+		t.Fatal(err)
+	}
+	started := p != nil
+	Close()
+	if started {
+		t.Error("Open started a pager without /dev/tty")
+	}
+	if !strings.Contains(logged.String(), "no controlling terminal") {
+		t.Errorf("logged %q, want why paging was skipped", logged.String())
+	}
+}
+
+func TestExitCodeHandler(t *testing.T) {
+	testPager(t, "cat >/dev/null; exit $CODE")
+	failed := errors.New("failed")
+	handler := func(code int) error {
+		if code == 2 {
+			return nil
+		}
+		return failed
+	}
+	for code, want := range map[string]error{"0": nil, "2": nil, "3": failed} {
+		setenv(t, "CODE", code)
+		if err := Open(WithExitCodeHandler(handler)); err != nil {
+			t.Fatal(err)
+		}
+		if err := Close(); err != want {
+			t.Errorf("Close with the pager exiting %s = %v, want %v", code, err, want)
+		}
+	}
+	// Without a handler any failure is an *exec.ExitError.
+	setenv(t, "CODE", "3")
+	if err := Open(); err != nil {
+		t.Fatal(err)
+	}
+	var exitErr *exec.ExitError
+	if err := Close(); !errors.As(err, &exitErr) {
+		t.Errorf("Close with the pager exiting 3 = %v, want an *exec.ExitError", err)
+	}
+}
+
+func TestSignalChannel(t *testing.T) {
+	testPager(t, "cat >/dev/null; exec sleep 0.3")
+	ch := make(chan os.Signal, 2)
+	if err := Open(WithSignalChannel(ch)); err != nil {
+		t.Fatal(err)
+	}
+	for _, sig := range []unix.Signal{unix.SIGINT, unix.SIGWINCH} {
+		if err := unix.Kill(os.Getpid(), sig); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got := <-ch:
+			if got != sig {
+				t.Errorf("channel got %v, want %v", got, sig)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%v not passed on to the channel", sig)
+		}
+	}
+	// Signals keep coming while the user reads the output.
+	signalDuringClose(unix.SIGINT)
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-ch:
+		if got != unix.SIGINT {
+			t.Errorf("channel got %v during Close, want SIGINT", got)
+		}
+	default:
+		t.Error("SIGINT during Close not passed on to the channel")
+	}
+}
+
+func TestArgv0(t *testing.T) {
+	o := newOptions(nil)
+	for _, tc := range []struct {
+		path string
+		c    candidate
+		want []string
+	}{
+		{"/usr/bin/less", candidate{"less", []string{"less"}}, []string{"less"}},
+		{"/usr/bin/less", candidate{"/usr/bin/less", []string{"/usr/bin/less", "-i"}}, []string{"less", "-i"}},
+		{"/opt/bin/mypager", candidate{"./mypager", []string{"./mypager"}}, []string{"mypager"}},
+	} {
+		if got := o.argv(tc.path, tc.c); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("argv(%q, %q) = %q, want %q", tc.path, tc.c.args, got, tc.want)
+		}
+	}
+	o = newOptions([]Option{WithArgv0("mypager")})
+	c := candidate{"less", []string{"less", "-i"}}
+	if got, want := o.argv("/usr/bin/less", c), []string{"mypager", "-i"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("argv with WithArgv0 = %q, want %q", got, want)
+	}
+	if !reflect.DeepEqual(c.args, []string{"less", "-i"}) {
+		t.Errorf("argv changed the candidate's args to %q", c.args)
+	}
+}
+
+func TestOpenDeferred(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	testPager(t, "cat >"+out)
+	if err := OpenDeferred(); err != nil {
+		t.Fatal(err)
+	}
+	if p != nil || IsRedirected() {
+		t.Fatal("OpenDeferred started paging before BeginPaging")
+	}
+	if err := BeginPaging(); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Println("hello from my pager!")
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(out); err != nil || string(got) != "hello from my pager!\n" {
+		t.Errorf("pager read %q, %v, want the output after BeginPaging", got, err)
+	}
+	// Closing without BeginPaging leaves nothing pending.
+	if err := OpenDeferred(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := BeginPaging(); err != nil || p != nil {
+		Close()
+		t.Error("BeginPaging after Close started a pager")
+	}
+
+	// A subcommand's Open and Close while paging is pending don't cancel
+	// it, and the pager then lasts until the outer Close.
+	os.Remove(out)
+	if err := OpenDeferred(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Open(); err != nil {
+		t.Fatal(err)
+	}
+	if p != nil {
+		t.Error("Open started paging while it was pending")
+	}
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := BeginPaging(); err != nil {
+		t.Fatal(err)
+	}
+	if err := OpenDeferred(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	redirected := IsRedirected()
+	fmt.Println("hello again!")
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !redirected {
+		t.Error("inner Open and Close cancelled the pending paging")
+	}
+	if got, err := os.ReadFile(out); err != nil || string(got) != "hello again!\n" {
+		t.Errorf("pager read %q, %v, want the output after BeginPaging", got, err)
+	}
+}
+
+func TestReadDuration(t *testing.T) {
+	testPager(t, "cat >/dev/null; exec sleep 0.1")
+	if err := Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	if d := ReadDuration(); d < 100*time.Millisecond {
+		t.Errorf("ReadDuration = %v, want at least the 100ms the pager ran", d)
+	}
+}
+
+func TestTimings(t *testing.T) {
+	testPager(t, "cat >/dev/null; exec sleep 0.1")
+	phases := map[string]time.Duration{}
+	timings := WithTimings(func(phase string, d time.Duration) {
+		phases[phase] += d
+	})
+	if err := Open(timings); err != nil {
+		t.Fatal(err)
+	}
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, phase := range []string{"select", "spawn", "wait"} {
+		if phases[phase] <= 0 {
+			t.Errorf("phase %q took %v, want it reported", phase, phases[phase])
+		}
+	}
+	if len(phases) != 3 {
+		t.Errorf("phases reported = %v, want select, spawn and wait", phases)
+	}
+	if phases["wait"] < 100*time.Millisecond {
+		t.Errorf("wait took %v, want at least the 100ms the pager ran", phases["wait"])
+	}
+}
+
+func TestNoSignalHandling(t *testing.T) {
+	testPager(t, "cat >/dev/null")
+	defaultInterrupt()
+	err := Open(WithNoSignalHandling(true), WithForwardInterrupt(true), WithRestoreOnExit(true), WithHangupHandling(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ignored := signal.Ignored(os.Interrupt)
+	interrupts, pipes, hangups := p.interrupts, p.pipes, p.hangups
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	if ignored {
+		t.Error("SIGINT ignored while the pager ran")
+	}
+	if interrupts != nil || pipes != nil || hangups != nil {
+		t.Error("signals notified while the pager ran")
+	}
+}
+
+func TestCloseSignal(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []Option
+		sig  string
+		want bool
+	}{
+		{"default", nil, "CONT", true},
+		{"nil", []Option{WithCloseSignal(nil)}, "CONT", false},
+		{"SIGUSR1", []Option{WithCloseSignal(unix.SIGUSR1)}, "USR1", true},
+	} {
+		dir := t.TempDir()
+		out, ready := filepath.Join(dir, "out"), filepath.Join(dir, "ready")
+		testPager(t, trapScript(tc.sig, out, ready))
+		if err := Open(tc.opts...); err != nil {
+			t.Fatal(err)
+		}
+		waitForFile(t, ready)
+		if err := Close(); err != nil {
+			t.Fatalf("%s: Close = %v", tc.name, err)
+		}
+		got, err := os.ReadFile(out)
+		if tc.want && (err != nil || string(got) != tc.sig+"\n") {
+			t.Errorf("%s: pager recorded %q, %v, want SIG%s", tc.name, got, err, tc.sig)
+		}
+		if !tc.want && err == nil {
+			t.Errorf("%s: pager got SIG%s", tc.name, tc.sig)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2019 Mike Gerow
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pager
+
+import "os"
+
+// PagingPlan describes what a call to Open would do, as returned by Plan.
+type PagingPlan struct {
+	// Page reports whether Open would page. If not, Reason says why.
+	Page   bool
+	Reason string
+	// Reused is set if a pager is already running, which Open would reuse.
+	Reused bool
+	// Path and Argv are the pager Open would start and its argv, or the
+	// running one's if Reused is set.
+	Path string
+	Argv []string
+	// Env holds the variables, as "key=value", that the pager's
+	// environment would set differently from the program's, as in Config.
+	Env []string
+	// LessFlags maps the WithLessFlag flags to the version of less each
+	// needs. Open adds those the pager supports to Argv, but finding the
+	// version means running less, which Plan doesn't do.
+	LessFlags map[string]int
+}
+
+// Plan reports what Open would do given opts, without starting anything or
+// redirecting any output, for example to print from a --debug flag. It makes
+// the same checks as Open and picks the pager the same way, but can't tell
+// that a pager would fail to start, in which case Open would go on to the
+// next candidate, nor which WithLessFlag flags less supports, as that takes
+// running it; LessFlags lists them instead. It returns the errors Open would,
+// as with WithStrict, and calls any WithPreSpawn hook, since that may change
+// what's started. With both WithStdoutPager and WithStderrPager, it describes
+// the stdout pager.
+func Plan(opts ...Option) (PagingPlan, error) {
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+	if p != nil {
+		return PagingPlan{
+			Page:   true,
+			Reused: true,
+			Path:   p.path,
+			Argv:   append([]string(nil), p.argv...),
+			Env:    envChanges(p.env, os.Environ()),
+		}, nil
+	}
+	o := newOptions(opts)
+	o.useStreamPager()
+	// Open would log these, but Plan only reports them.
+	o.quiet = true
+	o.noVersionProbe = true
+	if reason := skipReason(o); reason != "" {
+		return PagingPlan{Reason: reason}, nil
+	}
+	cs, err := candidates(o)
+	if err != nil {
+		return PagingPlan{}, err
+	}
+	tried := make(map[string]bool)
+	var env []string
+	for _, c := range cs {
+		pc, ok, err := prepare(o, c, tried, &env)
+		if err != nil {
+			return PagingPlan{}, err
+		}
+		if ok {
+			plan := PagingPlan{
+				Page: true,
+				Path: pc.path,
+				Argv: pc.argv,
+				Env:  envChanges(pc.env, os.Environ()),
+			}
+			if isLess(pc.path) {
+				for _, f := range o.versionedFlags {
+					if plan.LessFlags == nil {
+						plan.LessFlags = make(map[string]int)
+					}
+					plan.LessFlags[f.flag] = f.minVersion
+				}
+			}
+			return plan, nil
+		}
+	}
+	return PagingPlan{Reason: "no suitable pager found"}, nil
+}
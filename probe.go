@@ -0,0 +1,62 @@
+// Copyright 2019 Mike Gerow
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pager
+
+import (
+	"bytes"
+	"os/exec"
+	"strconv"
+	"sync"
+)
+
+var (
+	lessVersionsMu sync.Mutex
+	// lessVersions caches lessVersion's results by path.
+	lessVersions = make(map[string]int)
+)
+
+// lessVersion returns the version of the less at path, like 590, or 0 if it
+// can't be told, as with less from BusyBox. less is only run once per path.
+func lessVersion(path string) int {
+	lessVersionsMu.Lock()
+	defer lessVersionsMu.Unlock()
+	if v, ok := lessVersions[path]; ok {
+		return v
+	}
+	v := 0
+	if out, err := exec.Command(path, "--version").Output(); err == nil {
+		v = parseLessVersion(out)
+	}
+	lessVersions[path] = v
+	return v
+}
+
+// parseLessVersion returns the version from the output of less --version,
+// which starts like "less 590 (GNU regular expressions)", or 0.
+func parseLessVersion(out []byte) int {
+	f := bytes.Fields(out)
+	if len(f) < 2 || string(f[0]) != "less" {
+		return 0
+	}
+	n := 0
+	for n < len(f[1]) && f[1][n] >= '0' && f[1][n] <= '9' {
+		n++
+	}
+	v, err := strconv.Atoi(string(f[1][:n]))
+	if err != nil {
+		return 0
+	}
+	return v
+}
@@ -0,0 +1,147 @@
+// Copyright 2019 Mike Gerow
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pager
+
+import (
+	"io"
+	"os"
+	"os/signal"
+
+	"golang.org/x/sys/unix"
+)
+
+// ptyProxy connects a pager running on a pseudo-terminal of its own, for
+// WithPTY, to the program's terminal.
+type ptyProxy struct {
+	master *os.File
+	// term is a duplicate of the terminal the pager draws to, which stays
+	// on the terminal once that is redirected. Keys are read from input,
+	// the controlling terminal, since term may be open for writing only.
+	term, input *os.File
+	// termios is the terminal mode to restore once the pager is done.
+	termios *unix.Termios
+	resizes chan os.Signal
+	// done is closed once everything the pager drew has reached term.
+	done chan struct{}
+}
+
+// newPTY allocates a pseudo-terminal for the pager, returning the proxy for it
+// and the slave end to start the pager on, for the terminal tty. The slave
+// starts out with the terminal's mode, termios, and size.
+func newPTY(tty int, termios *unix.Termios) (*ptyProxy, *os.File, error) {
+	master, slave, err := openpty()
+	if err != nil {
+		return nil, nil, err
+	}
+	t := &ptyProxy{
+		master:  master,
+		termios: termios,
+		done:    make(chan struct{}),
+	}
+	fd, err := dupCloexec(tty)
+	if err != nil {
+		slave.Close()
+		t.release()
+		return nil, nil, err
+	}
+	t.term = os.NewFile(uintptr(fd), "/dev/tty")
+	if t.input, err = os.Open("/dev/tty"); err != nil {
+		slave.Close()
+		t.release()
+		return nil, nil, err
+	}
+	if termios != nil {
+		// The pager sets the mode it needs; this only keeps settings like
+		// the erase character the user is used to.
+		unix.IoctlSetTermios(int(slave.Fd()), ioctlSetTermios, termios)
+	}
+	t.resize()
+	return t, slave, nil
+}
+
+// resize gives the pty the size of the terminal, which sends the pager
+// SIGWINCH if it changed.
+func (t *ptyProxy) resize() {
+	ws, err := unix.IoctlGetWinsize(int(t.term.Fd()), unix.TIOCGWINSZ)
+	if err != nil {
+		return
+	}
+	unix.IoctlSetWinsize(int(t.master.Fd()), unix.TIOCSWINSZ, ws)
+}
+
+// start puts the terminal in raw mode, so that every key reaches the pager
+// as is, and starts copying between the terminal and the pty. If resizing is
+// set, the pty follows the terminal's size, from SIGWINCH.
+func (t *ptyProxy) start(resizing bool) {
+	if t.termios != nil {
+		unix.IoctlSetTermios(int(t.term.Fd()), ioctlSetTermios, makeRaw(t.termios))
+	}
+	if resizing {
+		t.resizes = make(chan os.Signal, 1)
+		signal.Notify(t.resizes, unix.SIGWINCH)
+		go func(resizes <-chan os.Signal) {
+			for range resizes {
+				t.resize()
+			}
+		}(t.resizes)
+	}
+	// Ends once release closes input.
+	go io.Copy(t.master, t.input)
+	go func() {
+		defer close(t.done)
+		// Reading the master fails once the pager has exited and nothing
+		// else has the slave open.
+		io.Copy(t.term, t.master)
+		// Output written after the pager quit, as with
+		// WithRestoreOnExit, shouldn't have to wait for Close to render.
+		restoreTermios(int(t.term.Fd()), t.termios)
+	}()
+}
+
+// close waits for the pager's output to reach the terminal, which it has soon
+// after the pager exits, and releases the pty.
+func (t *ptyProxy) close() {
+	<-t.done
+	if t.resizes != nil {
+		signal.Stop(t.resizes)
+		close(t.resizes)
+	}
+	t.release()
+}
+
+// release closes the pty and the files used to reach the terminal.
+func (t *ptyProxy) release() {
+	if t.input != nil {
+		t.input.Close()
+	}
+	if t.term != nil {
+		t.term.Close()
+	}
+	t.master.Close()
+}
+
+// makeRaw returns t changed to raw mode, as cfmakeraw does.
+func makeRaw(t *unix.Termios) *unix.Termios {
+	raw := *t
+	raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP |
+		unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	raw.Oflag &^= unix.OPOST
+	raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Cflag &^= unix.CSIZE | unix.PARENB
+	raw.Cflag |= unix.CS8
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	return &raw
+}
@@ -0,0 +1,29 @@
+// Copyright 2019 Mike Gerow
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package pager
+
+import (
+	"errors"
+	"os"
+)
+
+// openpty would return the master and slave ends of a new pseudo-terminal,
+// but allocating one differs between the BSDs and isn't implemented yet.
+func openpty() (master, slave *os.File, err error) {
+	return nil, nil, errors.New("not supported on this system")
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 Mike Gerow
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pager
+
+import (
+	"io"
+	"os"
+)
+
+// needsRelay reports whether the options require the program's output to be
+// passed through the package on its way to the pager at path.
+func (o *options) needsRelay(path string) bool {
+	return o.capture != nil || o.stripColor(path) || o.replayOnExit
+}
+
+// relay copies the program's output from src to the pager through dst,
+// mirroring it to any capture and to replay, if not nil, and stripping colors
+// if strip is set, and closes done when src reaches EOF. If the pager goes
+// away it closes src, so that the program's writes fail just as they would if
+// it wrote to the pager directly.
+func relay(dst, src *os.File, o *options, strip bool, replay io.Writer, done chan<- struct{}) {
+	defer close(done)
+	defer dst.Close()
+	defer src.Close()
+	var w io.Writer = dst
+	if strip {
+		w = &ansiStripper{w: w}
+		if replay != nil {
+			replay = &ansiStripper{w: replay}
+		}
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if o.capture != nil {
+				o.capture.Write(buf[:n])
+			}
+			if replay != nil {
+				replay.Write(buf[:n])
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// ansiStripper removes ANSI escape sequences from what is written through it,
+// even when a sequence is split across writes.
+type ansiStripper struct {
+	w     io.Writer
+	state int
+	out   []byte
+}
+
+const (
+	ansiText = iota
+	// ansiEscape follows an ESC.
+	ansiEscape
+	// ansiCSI is within an ESC [ sequence, which ends with a byte from @
+	// to ~.
+	ansiCSI
+	// ansiOSC is within an ESC ] sequence, which ends with BEL or ESC \.
+	ansiOSC
+	ansiOSCEscape
+)
+
+func (a *ansiStripper) Write(b []byte) (int, error) {
+	a.out = a.out[:0]
+	for _, c := range b {
+		switch a.state {
+		case ansiText:
+			if c == 0x1b {
+				a.state = ansiEscape
+			} else {
+				a.out = append(a.out, c)
+			}
+		case ansiEscape:
+			switch c {
+			case '[':
+				a.state = ansiCSI
+			case ']':
+				a.state = ansiOSC
+			default:
+				// Other sequences end at the first byte that isn't an
+				// intermediate, as in ESC ( B.
+				if c < 0x20 || c > 0x2f {
+					a.state = ansiText
+				}
+			}
+		case ansiCSI:
+			if c >= 0x40 && c <= 0x7e {
+				a.state = ansiText
+			}
+		case ansiOSC:
+			if c == 0x07 {
+				a.state = ansiText
+			} else if c == 0x1b {
+				a.state = ansiOSCEscape
+			}
+		case ansiOSCEscape:
+			if c == '\\' {
+				a.state = ansiText
+			} else {
+				a.state = ansiOSC
+			}
+		}
+	}
+	if _, err := a.w.Write(a.out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
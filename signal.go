@@ -0,0 +1,162 @@
+// Copyright 2019 Mike Gerow
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pager
+
+import (
+	"os"
+	"os/signal"
+
+	"golang.org/x/sys/unix"
+)
+
+// handleSignals sets up how the program reacts to signals while the pager
+// runs.
+func (p *pgr) handleSignals() {
+	if p.opts.noSignalHandling {
+		return
+	}
+	if p.opts.restoreOnExit {
+		// Writes racing with the restore after the pager exits would
+		// otherwise kill the program with SIGPIPE. Asking for the signal
+		// makes them fail with EPIPE instead.
+		p.pipes = make(chan os.Signal, 1)
+		signal.Notify(p.pipes, unix.SIGPIPE)
+	}
+	if p.opts.hangupHandling {
+		p.hangups = make(chan os.Signal, 1)
+		signal.Notify(p.hangups, unix.SIGHUP)
+		go func(hangups <-chan os.Signal) {
+			for range hangups {
+				p.hangup()
+			}
+		}(p.hangups)
+	}
+	if ch := p.opts.signalChan; ch != nil {
+		// The program dispatches signals itself, so leave SIGINT alone
+		// and hand it what arrives.
+		p.interruptIgnored = signal.Ignored(os.Interrupt)
+		p.forwarded = make(chan os.Signal, 1)
+		signal.Notify(p.forwarded, forwardedSignals...)
+		go func(forwarded <-chan os.Signal) {
+			for sig := range forwarded {
+				select {
+				case ch <- sig:
+				default:
+					// Like signal.Notify, don't block on a full
+					// channel.
+				}
+			}
+		}(p.forwarded)
+		return
+	}
+	if !p.opts.forwardInterrupt {
+		if p.foreground != 0 || p.pty != nil {
+			// The pager is the foreground group, or on a terminal of its
+			// own, so interrupts typed at the terminal reach it alone and
+			// there's nothing to hide from us.
+			return
+		}
+		if p.passthrough {
+			// Nothing is being paged, so an interrupt should stop the
+			// program as it would without cat.
+			return
+		}
+		if p.scoped {
+			// Catch SIGINT instead, which stopping undoes, and which
+			// the commands started meanwhile don't inherit as ignored.
+			if !signal.Ignored(os.Interrupt) {
+				p.caught = make(chan os.Signal, 1)
+				signal.Notify(p.caught, os.Interrupt)
+			}
+			return
+		}
+		// Ignore SIGINT, letting our pager handle it if it finds it
+		// appropriate. This feels like hacky, but it works, so eh?
+		p.interruptIgnored = signal.Ignored(os.Interrupt)
+		p.ignoringInterrupt = true
+		signal.Ignore(os.Interrupt)
+		return
+	}
+	p.interruptIgnored = signal.Ignored(os.Interrupt)
+	p.interrupts = make(chan os.Signal, 1)
+	signal.Notify(p.interrupts, os.Interrupt)
+	go func(proc *os.Process, interrupts <-chan os.Signal, f func()) {
+		for range interrupts {
+			// The pager may have already exited, nothing to do then.
+			proc.Signal(os.Interrupt)
+			if f != nil {
+				f()
+			}
+		}
+	}(p.proc, p.interrupts, p.opts.onInterrupt)
+}
+
+// forwardedSignals are the signals WithSignalChannel passes on.
+var forwardedSignals = []os.Signal{os.Interrupt, unix.SIGWINCH, unix.SIGCONT}
+
+// restoreSignals undoes what handleSignals did, where that's possible.
+func (p *pgr) restoreSignals() {
+	if p.pipes != nil {
+		signal.Stop(p.pipes)
+		p.pipes = nil
+	}
+	if p.hangups != nil {
+		signal.Stop(p.hangups)
+		close(p.hangups)
+		p.hangups = nil
+	}
+	if p.forwarded != nil {
+		signal.Stop(p.forwarded)
+		close(p.forwarded)
+		p.forwarded = nil
+		if p.interruptIgnored {
+			signal.Ignore(os.Interrupt)
+		}
+	}
+	if p.caught != nil {
+		signal.Stop(p.caught)
+		p.caught = nil
+	}
+	if p.interrupts == nil {
+		return
+	}
+	signal.Stop(p.interrupts)
+	close(p.interrupts)
+	p.interrupts = nil
+	if p.interruptIgnored {
+		signal.Ignore(os.Interrupt)
+	}
+}
+
+// restoreForeground gives the terminal back to the process group that had it
+// before the pager was made the foreground group.
+func (p *pgr) restoreForeground() error {
+	if p.foreground == 0 {
+		return nil
+	}
+	if p.opts.noSignalHandling {
+		// The program has to ignore SIGTTOU itself then.
+		return tcsetpgrp(p.opts.ttyFD(), p.foreground)
+	}
+	// Changing the foreground group from the background raises SIGTTOU,
+	// which would stop the program.
+	ignored := signal.Ignored(unix.SIGTTOU)
+	signal.Ignore(unix.SIGTTOU)
+	err := tcsetpgrp(p.opts.ttyFD(), p.foreground)
+	if !ignored {
+		signal.Reset(unix.SIGTTOU)
+	}
+	return err
+}
@@ -0,0 +1,41 @@
+// Copyright 2019 Mike Gerow
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package pager
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ioctlGetTermios = unix.TCGETS
+	// Wait for pending output to drain before changing the terminal mode.
+	ioctlSetTermios = unix.TCSETSW
+)
+
+// tcsetpgrp makes pgid the foreground process group of the terminal fd.
+func tcsetpgrp(fd, pgid int) error {
+	return unix.IoctlSetPointerInt(fd, unix.TIOCSPGRP, pgid)
+}
+
+// setPipeSize sets the capacity of the pipe f to at least n bytes.
+func setPipeSize(f *os.File, n int) error {
+	_, err := unix.FcntlInt(f.Fd(), unix.F_SETPIPE_SZ, n)
+	return err
+}
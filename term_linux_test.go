@@ -0,0 +1,128 @@
+// Copyright 2019 Mike Gerow
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pager
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// openPTY returns the master and slave ends of a new pseudo-terminal.
+func openPTY(t *testing.T) (master, slave *os.File) {
+	t.Helper()
+	master, slave, err := openpty()
+	if err != nil {
+		t.Skipf("no pty support: %v", err)
+	}
+	t.Cleanup(func() {
+		master.Close()
+		slave.Close()
+	})
+	return master, slave
+}
+
+func TestRestoreTermios(t *testing.T) {
+	_, tty := openPTY(t)
+	fd := int(tty.Fd())
+	saved := saveTermios(fd)
+	if saved == nil {
+		t.Fatal("saveTermios returned nil for a pty")
+	}
+	if saved.Lflag&unix.ICANON == 0 {
+		t.Fatal("new pty is not in canonical mode")
+	}
+
+	// Leave the terminal in raw mode the way a killed pager would.
+	raw := *saved
+	raw.Lflag &^= unix.ICANON | unix.ECHO
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &raw); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restoreTermios(fd, saved); err != nil {
+		t.Fatal(err)
+	}
+	got := saveTermios(fd)
+	if got.Lflag != saved.Lflag {
+		t.Errorf("Lflag after restore = %#x, want %#x", got.Lflag, saved.Lflag)
+	}
+}
+
+func TestEnvSize(t *testing.T) {
+	_, tty := openPTY(t)
+	if err := unix.IoctlSetWinsize(int(tty.Fd()), unix.TIOCSWINSZ, &unix.Winsize{Row: 40, Col: 100}); err != nil {
+		t.Fatal(err)
+	}
+	// Put the pty on stderr, which WithPageStderrOnly takes the size from.
+	stored, err := redirectFD(int(tty.Fd()), unix.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := newOptions([]Option{WithSizeEnv(true), WithPageStderrOnly(true)}).env()
+	dup2(stored, unix.Stderr)
+	closeFD(stored)
+	lines, _ := lookupEnv(env, "LINES")
+	columns, _ := lookupEnv(env, "COLUMNS")
+	if lines != "40" || columns != "100" {
+		t.Errorf("LINES, COLUMNS = %q, %q, want %q, %q", lines, columns, "40", "100")
+	}
+}
+
+func TestPipeBufferSize(t *testing.T) {
+	testPager(t, "cat >/dev/null")
+	if err := Open(WithPipeBufferSize(1 << 20)); err != nil {
+		t.Fatal(err)
+	}
+	size, err := unix.FcntlInt(PipeWriter().Fd(), unix.F_GETPIPE_SZ, 0)
+	if cerr := Close(); cerr != nil {
+		t.Fatal(cerr)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 1<<20 {
+		t.Errorf("pipe holds %d bytes, want %d", size, 1<<20)
+	}
+}
+
+// BenchmarkPipeBufferSize pages 8MiB to a pager reading it in small pieces,
+// with the default pipe and an enlarged one.
+func BenchmarkPipeBufferSize(b *testing.B) {
+	testPager(b, "dd bs=512 of=/dev/null 2>/dev/null")
+	chunk := bytes.Repeat([]byte("hello from my pager!\n"), 1<<10)
+	for _, size := range []int{0, 1 << 20} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			b.SetBytes(int64(len(chunk)) * 400)
+			for i := 0; i < b.N; i++ {
+				err := Page(func(w io.Writer) error {
+					for j := 0; j < 400; j++ {
+						if _, err := w.Write(chunk); err != nil {
+							return err
+						}
+					}
+					return nil
+				}, WithPipeBufferSize(size))
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2019 Mike Gerow
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build solaris
+// +build solaris
+
+package pager
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ioctlGetTermios = unix.TCGETS
+	// Wait for pending output to drain before changing the terminal mode.
+	ioctlSetTermios = unix.TCSETSW
+)
+
+// tcsetpgrp would make pgid the foreground process group of the terminal fd,
+// but x/sys offers no ioctl taking a pointer to it here, so WithSetpgid can't
+// hand the terminal back.
+func tcsetpgrp(fd, pgid int) error {
+	return errors.New("not supported on this system")
+}
+
+// setPipeSize does nothing, as pipes can't be resized on this system.
+func setPipeSize(f *os.File, n int) error {
+	return nil
+}